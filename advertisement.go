@@ -33,6 +33,14 @@ func (b *Bot) AdvertisedCommands() []chat1.UserBotCommandInput {
 		})
 	}
 
+	for _, trigger := range b.builtinTriggers() {
+		commands = append(commands, chat1.UserBotCommandInput{
+			Name:        trigger,
+			Description: b.builtins[trigger].Description(),
+			Usage:       fmt.Sprintf("!%s %s", b.name, trigger),
+		})
+	}
+
 	extras := slices.Clone(b.advertisements)
 	slices.SortFunc(extras, func(a, b chat1.UserBotCommandInput) int {
 		return strings.Compare(a.Name, b.Name)
@@ -51,7 +59,7 @@ func (b *Bot) advertiseCommands() error {
 }
 
 func (b *Bot) helpExtendedDescription() *chat1.UserBotExtendedDescription {
-	help := strings.TrimSpace(b.resolvedHelp())
+	help := strings.TrimSpace(b.resolvedHelp(FormatKeybase))
 	if help == "" {
 		return nil
 	}
@@ -0,0 +1,252 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit results
+const (
+	AuditOK           = "ok"
+	AuditError        = "error"
+	AuditDenied       = "denied"
+	AuditPaused       = "paused"
+	AuditConfirm      = "awaiting confirmation"
+	AuditCancelled    = "cancelled"
+	AuditTimedOut     = "timed out"
+	AuditBusy         = "busy"
+	AuditUnrecognized = "unrecognized"
+)
+
+const (
+	defaultAuditLimit  = 20
+	maxAuditLineLength = 1024 * 1024
+)
+
+// AuditRecord is a line in the audit log, written for every command the bot
+// is asked to run
+type AuditRecord struct {
+	Time     time.Time     `json:"time"`
+	User     string        `json:"user"`
+	UserID   string        `json:"user_id,omitempty"`
+	Backend  string        `json:"backend,omitempty"`
+	Channel  string        `json:"channel,omitempty"`
+	Args     []string      `json:"args"`
+	JobID    string        `json:"job_id,omitempty"`
+	DryRun   bool          `json:"dry_run"`
+	Paused   bool          `json:"paused"`
+	Result   string        `json:"result"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// auditLog appends records to a JSONL file
+type auditLog struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+// AuditLogPath is where the bot keeps its audit log, next to its config
+func AuditLogPath() (string, error) {
+	path, err := getConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return path + "-audit.jsonl", nil
+}
+
+// SetAuditLog starts appending a record of every command to the file at path
+func (b *Bot) SetAuditLog(path string) error {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	b.auditLog = &auditLog{path: path, file: file}
+	return nil
+}
+
+func (a *auditLog) write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// audit records the outcome of req, if the bot has an audit log
+func (b *Bot) audit(req Request, result string, cmdErr error, started time.Time) {
+	if b.auditLog == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:     started.UTC(),
+		User:     req.Sender(),
+		UserID:   req.UserID,
+		Backend:  req.Backend,
+		Channel:  req.Channel,
+		Args:     req.Args,
+		JobID:    req.JobID,
+		DryRun:   b.Config().DryRun(),
+		Paused:   b.Config().Paused(),
+		Result:   result,
+		Duration: time.Since(started).Round(time.Millisecond),
+	}
+	if cmdErr != nil {
+		record.Error = cmdErr.Error()
+	}
+	if err := b.auditLog.write(record); err != nil {
+		log.Printf("Error writing audit log: %s", err)
+	}
+}
+
+// auditQuery filters audit records
+type auditQuery struct {
+	user    string
+	command []string
+	since   time.Time
+	until   time.Time
+	limit   int
+}
+
+func (q auditQuery) matches(record AuditRecord) bool {
+	if q.user != "" && !strings.EqualFold(q.user, record.User) && q.user != record.UserID {
+		return false
+	}
+	if len(q.command) > len(record.Args) {
+		return false
+	}
+	for i, arg := range q.command {
+		if record.Args[i] != arg {
+			return false
+		}
+	}
+	if !q.since.IsZero() && record.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && record.Time.After(q.until) {
+		return false
+	}
+	return true
+}
+
+// parseAuditTime accepts a duration ago (24h), a date (2006-01-02) or an
+// RFC 3339 time
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q, use a duration (24h), a date (2006-01-02) or an RFC 3339 time", s)
+}
+
+func parseAuditQuery(args []string, now time.Time) (auditQuery, error) {
+	var q auditQuery
+	var command, since, until string
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(new(bytes.Buffer))
+	flags.StringVar(&q.user, "user", "", "Only show commands sent by this user")
+	flags.StringVar(&command, "command", "", "Only show this command or subcommand, like \"release promote\"")
+	flags.StringVar(&since, "since", "", "Only show commands since this time")
+	flags.StringVar(&until, "until", "", "Only show commands until this time")
+	flags.IntVar(&q.limit, "limit", defaultAuditLimit, "Show at most this many of the latest commands")
+	if err := flags.Parse(args); err != nil {
+		return q, err
+	}
+	if flags.NArg() > 0 {
+		return q, fmt.Errorf("Unexpected arguments: %q", flags.Args())
+	}
+	q.command = strings.Fields(command)
+	var err error
+	if since != "" {
+		if q.since, err = parseAuditTime(since, now); err != nil {
+			return q, err
+		}
+	}
+	if until != "" {
+		if q.until, err = parseAuditTime(until, now); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// readAudit returns the latest records matching q, oldest first
+func readAudit(path string, q auditQuery) ([]AuditRecord, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxAuditLineLength)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Skipping bad audit record: %s", err)
+			continue
+		}
+		if !q.matches(record) {
+			continue
+		}
+		records = append(records, record)
+		if q.limit > 0 && len(records) > q.limit {
+			records = records[1:]
+		}
+	}
+	return records, scanner.Err()
+}
+
+func (b *Bot) queryAudit(_ context.Context, req Request) (string, error) {
+	if b.auditLog == nil {
+		return "I'm not keeping an audit log.", nil
+	}
+	q, err := parseAuditQuery(req.Args[1:], time.Now())
+	if err != nil {
+		return fmt.Sprintf("%s\nUsage: `!%s audit [--user <name>] [--command <command>] [--since <time>] [--until <time>] [--limit <n>]`",
+			err, b.name), nil
+	}
+	records, err := readAudit(b.auditLog.path, q)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "No matching commands.", nil
+	}
+	rows := [][]string{{"Time", "User", "Backend", "Command", "Result", "Duration"}}
+	for _, record := range records {
+		result := record.Result
+		if record.DryRun {
+			result += " (dry run)"
+		}
+		rows = append(rows, []string{record.Time.Format(time.RFC3339), record.User, record.Backend,
+			commandLine(record.Args), result, record.Duration.String()})
+	}
+	table, err := formatTable(rows)
+	if err != nil {
+		return "", err
+	}
+	return BlockQuote(table), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// AuthPolicy restricts who may run commands. It is loaded from the bot config.
+type AuthPolicy struct {
+	// Groups maps a group name to its members
+	Groups map[string][]string `json:",omitempty"`
+	// Commands maps a trigger or subcommand path (like "release promote") to
+	// who may run it. The longest matching path wins, and commands without a
+	// matching rule can be run by anyone.
+	Commands map[string]AuthRule `json:",omitempty"`
+}
+
+// AuthRule lists the users and groups allowed to run a command. A user is
+// either a bare Slack user ID or Keybase username, or one qualified with a
+// backend like "slack:U012AB3CD" or "keybase:alice". Usernames only count on
+// Keybase, since Slack handles can be changed.
+type AuthRule struct {
+	Users  []string `json:",omitempty"`
+	Groups []string `json:",omitempty"`
+}
+
+// Allowed checks whether the sender of req may run it. It returns the matching
+// command path, if any, so callers can explain a denial.
+func (p AuthPolicy) Allowed(req Request) (string, bool) {
+	path, rule, ok := matchPath(req.Args, p.Commands)
+	if !ok {
+		return "", true
+	}
+	if slices.ContainsFunc(rule.Users, req.isUser) {
+		return path, true
+	}
+	for _, group := range rule.Groups {
+		if slices.ContainsFunc(p.Groups[group], req.isUser) {
+			return path, true
+		}
+	}
+	return path, false
+}
+
+// isUser checks whether an allowlist entry refers to the sender
+func (r Request) isUser(entry string) bool {
+	backend, user, qualified := strings.Cut(entry, ":")
+	if !qualified {
+		user = entry
+	} else if backend != r.Backend {
+		return false
+	}
+	if user == "" {
+		return false
+	}
+	if r.Backend != BackendKeybase {
+		// Slack users can change their handle and anyone can take an IRC nick,
+		// so elsewhere only the fixed user ID (nick!user@host on IRC) counts
+		return user == r.UserID
+	}
+	return user == r.UserID || user == r.Username
+}
+
+func deniedMessage(req Request, path string) string {
+	return fmt.Sprintf("Sorry %s, you're not allowed to run `%s`.", req.Sender(), path)
+}
@@ -5,45 +5,98 @@ package slackbot
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
 type BotCommandRunner interface {
-	RunCommand(args []string, channel string) error
+	RunCommand(req Request) error
 }
 
 type BotBackend interface {
-	SendMessage(text string, channel string)
+	// SendMessage sends text to channel, returning a handle for editing the
+	// message, which is empty if the backend can't tell which message it sent
+	SendMessage(text string, channel string) MessageHandle
 	Listen(BotCommandRunner)
 }
 
+// namedBackend is a backend that says which Request.Backend its requests
+// have, so replies can find their way back to it
+type namedBackend interface {
+	BackendName() string
+}
+
+// replier is a backend that routes replies itself, like HybridBackend
+type replier interface {
+	Reply(req Request, text string) MessageHandle
+}
+
 // Bot describes a generic bot
 type Bot struct {
 	backend        BotBackend
 	help           string
+	helpDocument   Document
 	name           string
 	label          string
 	config         Config
 	commands       map[string]Command
+	builtins       map[string]Command
+	options        map[string]CommandOptions
+	defaultTimeout time.Duration
 	advertisements []chat1.UserBotCommandInput
 	defaultCommand Command
+	confirmations  *confirmations
+	jobs           *JobRegistry
+	locks          *locks
+	auditLog       *auditLog
+	threadReplies  bool
+	// uploadThreshold is how long a reply can be before it's uploaded
+	uploadThreshold int
+	// statusInterval is how often status messages are updated
+	statusInterval time.Duration
+	follows        *follows
+	// followInterval is how often a followed job's log is posted, at most
+	followInterval time.Duration
 }
 
 func NewBot(config Config, name, label string, backend BotBackend) *Bot {
-	return &Bot{
-		backend:  backend,
-		config:   config,
-		commands: make(map[string]Command),
-		name:     name,
-		label:    label,
+	b := &Bot{
+		backend:       backend,
+		config:        config,
+		commands:      make(map[string]Command),
+		builtins:      make(map[string]Command),
+		options:       make(map[string]CommandOptions),
+		name:          name,
+		label:         label,
+		confirmations: newConfirmations(),
+		jobs:          NewJobRegistry(),
+		locks:         newLocks(),
+
+		uploadThreshold: DefaultUploadThreshold,
+		statusInterval:  DefaultStatusInterval,
+		follows:         newFollows(),
+		followInterval:  DefaultFollowInterval,
 	}
+	b.builtins["confirm"] = NewRequestFuncCommand(b.confirm, "Confirm a dangerous command", config)
+	b.builtins["pending"] = NewRequestFuncCommand(b.listPending, "List commands waiting to be confirmed", config)
+	b.builtins["jobs"] = NewRequestFuncCommand(b.listJobs, "List running jobs", config)
+	b.builtins["cancel"] = NewRequestFuncCommand(b.cancelJob, "Cancel a running job by ID", config)
+	b.builtins["follow"] = NewRequestFuncCommand(b.followJob, "Post a running job's log as it's written", config)
+	b.builtins["unfollow"] = NewRequestFuncCommand(b.unfollowJob, "Stop posting a job's log", config)
+	b.builtins["queue"] = NewRequestFuncCommand(b.listQueue, "List jobs waiting for a lock", config)
+	b.builtins["rerun"] = NewRequestFuncCommand(b.rerun, "Run a job interrupted by a restart again", config)
+	b.builtins["dismiss"] = NewRequestFuncCommand(b.dismiss, "Forget a job interrupted by a restart", config)
+	b.builtins["audit"] = NewRequestFuncCommand(b.queryAudit, "Search the log of commands run", config)
+	return b
 }
 
 func (b *Bot) Name() string {
@@ -67,33 +120,61 @@ func (b *Bot) triggers() []string {
 	return triggers
 }
 
-// HelpMessage is the default help message for the bot
+func (b *Bot) builtinTriggers() []string {
+	triggers := make([]string, 0, len(b.builtins))
+	for trigger := range b.builtins {
+		if _, overridden := b.commands[trigger]; !overridden {
+			triggers = append(triggers, trigger)
+		}
+	}
+	sort.Strings(triggers)
+	return triggers
+}
+
+// HelpDocument is the default help for the bot, a table of its commands
+func (b *Bot) HelpDocument() Document {
+	rows := [][]string{{"Command", "Description"}}
+	for _, trigger := range b.triggers() {
+		rows = append(rows, []string{trigger, b.commands[trigger].Description()})
+	}
+	for _, trigger := range b.builtinTriggers() {
+		rows = append(rows, []string{trigger, b.builtins[trigger].Description()})
+	}
+	return Document{Table(rows)}
+}
+
+// HelpMessage is the default help message for the bot, as plain text in a
+// code block
 func (b *Bot) HelpMessage() string {
+	return BlockQuote(b.HelpDocument().Render(FormatPlain))
+}
+
+// formatTable aligns rows of cells into columns
+func formatTable(rows [][]string) (string, error) {
 	w := new(tabwriter.Writer)
 	buf := new(bytes.Buffer)
-	w.Init(buf, 8, 8, 8, ' ', 0)
-	if _, err := fmt.Fprintln(w, "Command\tDescription"); err != nil {
-		log.Printf("Error writing help header: %s", err)
-		return "Error generating help message"
-	}
-	for _, trigger := range b.triggers() {
-		command := b.commands[trigger]
-		if _, err := fmt.Fprintf(w, "%s\t%s\n", trigger, command.Description()); err != nil {
-			log.Printf("Error writing help command: %s", err)
-			return "Error generating help message"
+	w.Init(buf, 8, 8, 2, ' ', 0)
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return "", err
 		}
 	}
 	if err := w.Flush(); err != nil {
-		log.Printf("Error flushing help writer: %s", err)
-		return "Error generating help message"
+		return "", err
 	}
-	return BlockQuote(buf.String())
+	return buf.String(), nil
 }
 
 func (b *Bot) SetHelp(help string) {
 	b.help = help
 }
 
+// SetHelpDocument sets the help, rendered for each backend. SetHelp takes
+// precedence.
+func (b *Bot) SetHelpDocument(doc Document) {
+	b.helpDocument = doc
+}
+
 func (b *Bot) Label() string {
 	return b.label
 }
@@ -102,58 +183,262 @@ func (b *Bot) SetDefault(command Command) {
 	b.defaultCommand = command
 }
 
-// RunCommand runs a command
-func (b *Bot) RunCommand(args []string, channel string) error {
+// RunCommand runs a command, recording it in the audit log
+func (b *Bot) RunCommand(req Request) error {
+	args := req.Args
+	started := time.Now()
+	b.react(req, ReactionReceived)
 	if len(args) == 0 || args[0] == "help" {
-		b.sendHelpMessage(channel)
+		b.sendHelpMessage(req)
+		b.finish(req, AuditOK, b.resolvedHelp(FormatPlain), nil, started)
 		return nil
 	}
 
+	// Registered commands override builtins, except that cancel goes to the
+	// job registry when it names a job
 	command, ok := b.commands[args[0]]
+	builtin := false
+	if args[0] == "cancel" && b.isJobCancel(args) {
+		command, ok, builtin = b.builtins["cancel"], true, true
+	} else if !ok {
+		command, builtin = b.builtins[args[0]]
+		ok = builtin
+	}
 	if !ok {
 		if b.defaultCommand != nil {
 			command = b.defaultCommand
 		} else {
-			return fmt.Errorf("Unrecognized command: %q", args)
+			err := fmt.Errorf("Unrecognized command: %q", args)
+			b.finish(req, AuditUnrecognized, "", err, started)
+			return err
 		}
 	}
 
-	if args[0] != "resume" && args[0] != "config" && b.Config().Paused() {
-		b.backend.SendMessage("I can't do that, I'm paused.", channel)
+	if path, ok := b.Config().Auth().Allowed(req); !ok {
+		log.Printf("Denied %q for %s (%s)", args, req.Sender(), req.Backend)
+		msg := deniedMessage(req, path)
+		b.Reply(req, msg)
+		b.finish(req, AuditDenied, msg, nil, started)
+		return nil
+	}
+
+	if !builtin && args[0] != "resume" && args[0] != "config" && b.Config().Paused() {
+		msg := "I can't do that, I'm paused."
+		b.Reply(req, msg)
+		b.finish(req, AuditPaused, msg, nil, started)
 		return nil
 	}
 
-	go b.run(args, command, channel)
+	if b.optionsFor(args).needsConfirmation(args) {
+		msg := b.requestConfirmation(req, command)
+		b.finish(req, AuditConfirm, msg, nil, started)
+		return nil
+	}
+
+	log.Printf("Running %q for %s (%s)", args, req.Sender(), req.Backend)
+	if builtin {
+		go func() {
+			out, err := b.respond(context.Background(), req, command)
+			b.finish(req, auditResult(err), out, err, started)
+		}()
+	} else {
+		go b.run(req, command)
+	}
 	return nil
 }
 
-func (b *Bot) run(args []string, command Command, channel string) {
-	out, err := command.Run(channel, args)
+func auditResult(err error) string {
+	if err != nil {
+		return AuditError
+	}
+	return AuditOK
+}
+
+// run runs command as a job, waiting for its lock and cancelling it if it runs
+// past its timeout
+func (b *Bot) run(req Request, command Command) {
+	started := time.Now()
+	job := b.jobs.Start(req)
+	defer b.jobs.Finish(job)
+	if req.Started != nil {
+		req.Started(job.ID)
+	}
+	opts := b.optionsFor(req.Args)
+	if opts.Lock != "" {
+		unlock, err := b.lockJob(job, opts.Lock, !opts.RejectWhenBusy)
+		if err != nil {
+			log.Printf("Job %s didn't get lock %s: %s", job.ID, opts.Lock, err)
+			result := AuditCancelled
+			if errors.Is(err, ErrLockBusy) {
+				result = AuditBusy
+			}
+			b.finish(job.Request, result, "", err, started)
+			return
+		}
+		defer unlock()
+	}
+	timeout := b.timeoutFor(opts)
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			log.Printf("Job %s timed out after %s", job.ID, timeout)
+			if err := job.stop(true); err != nil {
+				log.Printf("Error stopping job %s: %s", job.ID, err)
+			}
+		})
+		defer timer.Stop()
+	}
+	go b.refreshStatus(job)
+	b.react(job.Request, ReactionRunning)
+	out, err := b.respond(job.Context(), job.Request, command)
+	b.unreact(job.Request, ReactionRunning)
+	result := auditResult(err)
+	switch {
+	case job.TimedOut():
+		result = AuditTimedOut
+		b.Reply(job.Request, fmt.Sprintf("Job %s (`%s`) was killed after running for longer than its %s timeout.",
+			job.ID, commandLine(req.Args), timeout))
+	case job.Context().Err() != nil:
+		result = AuditCancelled
+	}
+	b.finish(job.Request, result, out, err, started)
+}
+
+// finish records how a request ended and tells its sender, if they asked
+func (b *Bot) finish(req Request, status, out string, err error, started time.Time) {
+	b.audit(req, status, err, started)
+	b.FinishStatus(req, status)
+	if b.threaded(req) {
+		b.replyInChannel(req, jobSummary(req, status))
+	}
+	switch status {
+	case AuditConfirm:
+	case AuditOK:
+		b.react(req, ReactionSucceeded)
+	default:
+		b.react(req, ReactionFailed)
+	}
+	if req.Done != nil {
+		req.Done(Result{JobID: req.JobID, Status: status, Output: out, Err: err})
+	}
+}
+
+// respond runs command and sends its output back
+func (b *Bot) respond(ctx context.Context, req Request, command Command) (string, error) {
+	var doc Document
+	var out string
+	var err error
+	if dc, ok := command.(DocumentCommand); ok {
+		doc, err = dc.RunDocument(ctx, req)
+		out = doc.Render(FormatPlain)
+	} else {
+		out, err = runCommand(ctx, command, req)
+	}
 	if err != nil {
 		log.Printf("Error %s running: %#v; %s\n", err, command, out)
-		b.backend.SendMessage(fmt.Sprintf("Oops, there was an error in %q:\n%s", strings.Join(args, " "),
-			BlockQuote(out)), channel)
-		return
+		b.Reply(req, fmt.Sprintf("Oops, there was an error in %q:\n%s", strings.Join(req.Args, " "),
+			BlockQuote(out)))
+		return out, err
 	}
 	log.Printf("Output: %s\n", out)
-	if command.ShowResult() {
-		b.backend.SendMessage(out, channel)
+	switch {
+	case !command.ShowResult():
+	case doc != nil:
+		b.ReplyDocument(req, doc)
+	default:
+		b.Reply(req, out)
 	}
+	return out, nil
 }
 
-func (b *Bot) resolvedHelp() string {
+// resolvedHelpDocument is the help set with SetHelpDocument, or the default
+func (b *Bot) resolvedHelpDocument() Document {
+	if b.helpDocument != nil {
+		return b.helpDocument
+	}
+	return b.HelpDocument()
+}
+
+// resolvedHelp is the help set with SetHelp, or else the help document
+// rendered in format
+func (b *Bot) resolvedHelp(format Format) string {
 	if b.help != "" {
 		return b.help
 	}
-	return b.HelpMessage()
+	return b.resolvedHelpDocument().Render(format)
+}
+
+func (b *Bot) sendHelpMessage(req Request) {
+	if b.help != "" {
+		b.Reply(req, b.help)
+		return
+	}
+	b.ReplyDocument(req, b.resolvedHelpDocument())
 }
 
-func (b *Bot) sendHelpMessage(channel string) {
-	b.backend.SendMessage(b.resolvedHelp(), channel)
+// Backend returns the bot's backend
+func (b *Bot) Backend() BotBackend {
+	return b.backend
 }
 
-func (b *Bot) SendMessage(text string, channel string) {
-	b.backend.SendMessage(text, channel)
+func (b *Bot) SendMessage(text string, channel string) MessageHandle {
+	return b.backend.SendMessage(text, channel)
+}
+
+// Reply sends text back to where req came from: its channel, on the backend
+// that received it. With SetThreadReplies, replies about a job go in a thread
+// on the command's message. Text too long for one message is split into
+// several, or uploaded as a file if it's longer than the upload threshold.
+// The handle is of the last message sent, and empty for uploads.
+func (b *Bot) Reply(req Request, text string) MessageHandle {
+	if b.uploadReply(req, text) {
+		return MessageHandle{}
+	}
+	return b.replyMessages(req, text)
+}
+
+// replyMessages sends text back to where req came from, split into as many
+// messages as it takes
+func (b *Bot) replyMessages(req Request, text string) MessageHandle {
+	var handle MessageHandle
+	for _, chunk := range splitMessage(text, b.messageLimit(req)) {
+		handle = b.replyMessage(req, chunk)
+	}
+	return handle
+}
+
+// replyMessage sends one message back to where req came from
+func (b *Bot) replyMessage(req Request, text string) MessageHandle {
+	if b.threaded(req) {
+		handle, err := b.backend.(threadReplier).ReplyInThread(req, text)
+		if err == nil {
+			return handle
+		}
+		log.Printf("Error replying in thread, replying in the channel: %s", err)
+	}
+	return b.replyInChannel(req, text)
+}
+
+// replyInChannel sends text to req's channel, outside any thread
+func (b *Bot) replyInChannel(req Request, text string) MessageHandle {
+	if r, ok := b.backend.(replier); ok {
+		return r.Reply(req, text)
+	}
+	return b.backend.SendMessage(text, req.Channel)
+}
+
+// broadcaster is a backend with several default channels, like a hybrid
+type broadcaster interface {
+	Broadcast(text string)
+}
+
+// Broadcast sends an announcement, like "I'm running.", to every backend's
+// default channel
+func (b *Bot) Broadcast(text string) {
+	if bc, ok := b.backend.(broadcaster); ok {
+		bc.Broadcast(text)
+		return
+	}
+	b.backend.SendMessage(text, "")
 }
 
 func (b *Bot) Listen() {
@@ -163,9 +448,9 @@ func (b *Bot) Listen() {
 	b.backend.Listen(b)
 }
 
-// NewTestBot returns a bot for testing
+// NewTestBot returns a bot for testing, with a TestBackend
 func NewTestBot() (*Bot, error) {
-	backend := &SlackBotBackend{}
+	backend := NewTestBackend("testbot")
 	return NewBot(NewConfig(true, false), "testbot", "", backend), nil
 }
 
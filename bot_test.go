@@ -4,7 +4,15 @@
 package slackbot
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"github.com/stretchr/testify/require"
@@ -41,8 +49,9 @@ func TestAdvertisedCommands(t *testing.T) {
 	})
 
 	commands := bot.AdvertisedCommands()
-	if len(commands) != 3 {
-		t.Fatalf("expected 3 advertised commands, got %d", len(commands))
+	builtins := bot.builtinTriggers()
+	if len(commands) != 3+len(builtins) {
+		t.Fatalf("expected %d advertised commands, got %d", 3+len(builtins), len(commands))
 	}
 	if commands[0].Name != "help" {
 		t.Fatalf("expected help command first, got %q", commands[0].Name)
@@ -55,13 +64,601 @@ func TestAdvertisedCommands(t *testing.T) {
 		Description: "Show the current date",
 		Usage:       "!testbot date",
 	}) {
-		t.Fatalf("unexpected builtin command: %+v", commands[1])
+		t.Fatalf("unexpected registered command: %+v", commands[1])
 	}
 	if commands[2] != (chat1.UserBotCommandInput{
+		Name:        builtins[0],
+		Description: bot.builtins[builtins[0]].Description(),
+		Usage:       "!testbot " + builtins[0],
+	}) {
+		t.Fatalf("unexpected builtin command: %+v", commands[2])
+	}
+	if extra := commands[len(commands)-1]; extra != (chat1.UserBotCommandInput{
 		Name:        "build",
 		Description: "Build things",
 		Usage:       "!testbot build <target>",
 	}) {
-		t.Fatalf("unexpected extra command: %+v", commands[2])
+		t.Fatalf("unexpected extra command: %+v", extra)
+	}
+}
+
+func TestRunCommandPassesRequest(t *testing.T) {
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	got := make(chan Request, 1)
+	bot.AddCommand("whoami", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		got <- req
+		return req.Username, nil
+	}, "Who am I", bot.Config()))
+
+	req := Request{
+		Args:      []string{"whoami"},
+		Backend:   BackendKeybase,
+		Channel:   "conv",
+		UserID:    "uid",
+		Username:  "alice",
+		MessageID: "42",
+		Text:      "!testbot whoami",
+	}
+	require.NoError(t, bot.RunCommand(req))
+	ran := <-got
+	require.NotEmpty(t, ran.JobID)
+	ran.JobID = ""
+	require.Equal(t, req, ran)
+
+	// Plain commands still get the channel and args
+	out, err := runCommand(context.Background(), NewFuncCommand(func(channel string, args []string) (string, error) {
+		return channel + " " + args[0], nil
+	}, "", bot.Config()), req)
+	require.NoError(t, err)
+	require.Equal(t, "conv whoami", out)
+}
+
+func TestAuthPolicy(t *testing.T) {
+	policy := AuthPolicy{
+		Groups: map[string][]string{"release": {"keybase:alice", "U012AB3CD"}},
+		Commands: map[string]AuthRule{
+			"release":         {Users: []string{"bob"}},
+			"release promote": {Groups: []string{"release"}},
+		},
+	}
+	alice := Request{Backend: BackendKeybase, Username: "alice"}
+	slackAlice := Request{Backend: BackendSlack, UserID: "U999", Username: "alice"}
+	bob := Request{Backend: BackendKeybase, Username: "bob"}
+	// A Slack handle can be changed to match an allowlisted Keybase name
+	slackBob := Request{Backend: BackendSlack, UserID: "U0BOB", Username: "bob"}
+	slackUser := Request{Backend: BackendSlack, UserID: "U012AB3CD"}
+
+	cases := []struct {
+		req     Request
+		args    []string
+		path    string
+		allowed bool
+	}{
+		{alice, []string{"release", "promote", "darwin", "1.2.3"}, "release promote", true},
+		{slackAlice, []string{"release", "promote", "darwin", "1.2.3"}, "release promote", false},
+		{slackUser, []string{"release", "promote"}, "release promote", true},
+		{bob, []string{"release", "promote"}, "release promote", false},
+		{bob, []string{"release", "broken", "1.2.3"}, "release", true},
+		{slackBob, []string{"release", "broken", "1.2.3"}, "release", false},
+		{alice, []string{"release", "broken", "1.2.3"}, "release", false},
+		{alice, []string{"build", "darwin"}, "", true},
+		{alice, nil, "", true},
+	}
+	for _, c := range cases {
+		c.req.Args = c.args
+		path, allowed := policy.Allowed(c.req)
+		require.Equal(t, c.path, path, "%v %v", c.req.Sender(), c.args)
+		require.Equal(t, c.allowed, allowed, "%v %v", c.req.Sender(), c.args)
+	}
+}
+
+func TestConfirmations(t *testing.T) {
+	confs := newConfirmations()
+	now := time.Now()
+	alice := Request{Backend: BackendKeybase, Username: "alice", Args: []string{"release", "promote", "darwin", "1.2.3"}}
+	bob := Request{Backend: BackendKeybase, Username: "bob"}
+
+	conf, err := confs.add(alice, nil, now)
+	require.NoError(t, err)
+	require.Len(t, conf.token, 6)
+	require.Len(t, confs.list(now), 1)
+
+	_, err = confs.take(conf.token, bob, now)
+	require.Error(t, err)
+	_, err = confs.take("nope", alice, now)
+	require.Error(t, err)
+	taken, err := confs.take(conf.token, alice, now)
+	require.NoError(t, err)
+	require.Equal(t, alice.Args, taken.req.Args)
+	_, err = confs.take(conf.token, alice, now)
+	require.Error(t, err)
+
+	conf, err = confs.add(alice, nil, now)
+	require.NoError(t, err)
+	later := now.Add(ConfirmationTTL + time.Second)
+	require.Empty(t, confs.list(later))
+	_, err = confs.take(conf.token, alice, later)
+	require.Error(t, err)
+}
+
+func TestCommandLine(t *testing.T) {
+	require.Equal(t, `dumplog "release promote" ""`, commandLine([]string{"dumplog", "release promote", ""}))
+}
+
+func TestJobRegistry(t *testing.T) {
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	jobs := bot.Jobs()
+
+	first := jobs.Start(Request{Args: []string{"build", "darwin"}, Username: "alice"})
+	second := jobs.Start(Request{Args: []string{"date"}})
+	require.Equal(t, "1", first.ID)
+	require.Equal(t, "1", first.Request.JobID)
+	require.Equal(t, []*Job{first, second}, jobs.List())
+
+	require.NoError(t, jobs.Cancel(second.ID))
+	require.Error(t, second.Context().Err())
+	cancelled := false
+	first.SetCancel(func() error {
+		cancelled = true
+		return nil
+	})
+	require.NoError(t, jobs.Cancel(first.ID))
+	require.True(t, cancelled)
+
+	require.True(t, bot.isJobCancel([]string{"cancel", first.ID}))
+	require.True(t, bot.isJobCancel([]string{"cancel", "label"}))
+	bot.SetDefault(NewFuncCommand(nil, "Extension", bot.Config()))
+	require.False(t, bot.isJobCancel([]string{"cancel", "label"}))
+	require.True(t, bot.isJobCancel([]string{"cancel", first.ID}))
+
+	jobs.Finish(first)
+	_, ok := jobs.Get(first.ID)
+	require.False(t, ok)
+	require.Error(t, jobs.Cancel(first.ID))
+	require.Equal(t, []*Job{second}, jobs.List())
+}
+
+func TestCommandOverridesBuiltin(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	release := make(chan struct{})
+	bot.AddCommand("build", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		<-release
+		return "built", nil
+	}, "Build", bot.Config()))
+	bot.AddCommand("jobs", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		return "my jobs", nil
+	}, "List my jobs", bot.Config()))
+	bot.AddCommand("cancel", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		return "cancelled " + req.Args[1], nil
+	}, "Cancel by label", bot.Config()))
+	go bot.Listen()
+
+	backend.Inject("builds", "alice", "!testbot jobs")
+	_, err := backend.WaitForMessage("my jobs", 5*time.Second)
+	require.NoError(t, err)
+
+	// cancel still goes to the job registry when it names a job
+	backend.Inject("builds", "alice", "!testbot build")
+	require.Eventually(t, func() bool { return len(bot.Jobs().List()) == 1 }, 5*time.Second, time.Millisecond)
+	id := bot.Jobs().List()[0].ID
+	backend.Inject("builds", "alice", "!testbot cancel "+id)
+	_, err = backend.WaitForMessage("Cancelled job "+id, 5*time.Second)
+	require.NoError(t, err)
+	backend.Inject("builds", "alice", "!testbot cancel label")
+	_, err = backend.WaitForMessage("cancelled label", 5*time.Second)
+	require.NoError(t, err)
+	close(release)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	bot.AddCommand("hang", NewRequestFuncCommand(func(ctx context.Context, _ Request) (string, error) {
+		<-ctx.Done()
+		done <- ctx.Err()
+		return "", ctx.Err()
+	}, "Hang until cancelled", bot.Config()))
+	bot.SetOptions("hang", CommandOptions{Timeout: 10 * time.Millisecond})
+	require.Equal(t, 10*time.Millisecond, bot.timeoutFor(bot.optionsFor([]string{"hang"})))
+	require.Zero(t, bot.timeoutFor(bot.optionsFor([]string{"date"})))
+	bot.SetDefaultTimeout(time.Minute)
+	require.Equal(t, time.Minute, bot.timeoutFor(bot.optionsFor([]string{"date"})))
+
+	require.NoError(t, bot.RunCommand(Request{Args: []string{"hang"}}))
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command wasn't cancelled")
 	}
 }
+
+func TestExecCommandContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	command := NewExecCommand("/bin/sleep", []string{"5"}, true, "Sleep", &config{}).(RequestCommand)
+	start := time.Now()
+	_, err := command.RunRequest(ctx, Request{})
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestLocks(t *testing.T) {
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	first := bot.Jobs().Start(Request{Args: []string{"build", "darwin"}})
+	second := bot.Jobs().Start(Request{Args: []string{"build", "darwin"}})
+	third := bot.Jobs().Start(Request{Args: []string{"build", "darwin"}})
+
+	unlockFirst, err := bot.lockJob(first, "darwin-build", true)
+	require.NoError(t, err)
+	_, err = bot.lockJob(second, "darwin-build", false)
+	require.ErrorIs(t, err, ErrLockBusy)
+
+	locked := make(chan func(), 1)
+	go func() {
+		unlock, err := bot.LockJob(second, "darwin-build")
+		require.NoError(t, err)
+		locked <- unlock
+	}()
+	thirdErr := make(chan error, 1)
+	go func() {
+		_, err := bot.LockJob(third, "darwin-build")
+		thirdErr <- err
+	}()
+	require.Eventually(t, func() bool { return len(bot.locks.queued()) == 2 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, "darwin-build", second.QueuedFor())
+
+	// Cancelling a queued job takes it out of line
+	require.NoError(t, bot.Jobs().Cancel(third.ID))
+	require.ErrorIs(t, <-thirdErr, context.Canceled)
+	require.Len(t, bot.locks.queued(), 1)
+	require.Empty(t, third.QueuedFor())
+
+	// Releasing the lock hands it to the next job in line
+	unlockFirst()
+	unlockSecond := <-locked
+	require.Empty(t, second.QueuedFor())
+	require.Empty(t, bot.locks.queued())
+	_, _, holder := bot.locks.acquire("darwin-build", first, false)
+	require.Equal(t, second, holder)
+	unlockSecond()
+	_, _, holder = bot.locks.acquire("darwin-build", first, false)
+	require.Nil(t, holder)
+
+	// A job is queued as it gets in line, so a release straight after hands
+	// it the lock without leaving it marked as queued
+	waiter, _, _ := bot.locks.acquire("darwin-build", second, true)
+	require.Equal(t, "darwin-build", second.QueuedFor())
+	bot.locks.release("darwin-build", first)
+	<-waiter.ready
+	require.Empty(t, second.QueuedFor())
+}
+
+func TestRestoreJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	before, err := NewTestBot()
+	require.NoError(t, err)
+	require.NoError(t, before.RestoreJobs(path))
+	before.Jobs().Start(Request{Args: []string{"restart"}})
+	interrupted := before.Jobs().Start(Request{Args: []string{"build", "darwin"}, Username: "alice"})
+	finished := before.Jobs().Start(Request{Args: []string{"date"}})
+	before.Jobs().Finish(finished)
+
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	got := make(chan Request, 1)
+	bot.AddCommand("build", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		got <- req
+		return "", nil
+	}, "Build", bot.Config()))
+	bot.SetOptions("restart", CommandOptions{Transient: true})
+	require.NoError(t, bot.RestoreJobs(path))
+	require.Len(t, bot.jobs.interrupted, 1)
+	require.Contains(t, bot.jobs.interrupted, interrupted.ID)
+
+	// Interrupted jobs are kept through another restart until they're run
+	// again or dismissed
+	again, err := NewTestBot()
+	require.NoError(t, err)
+	require.NoError(t, again.RestoreJobs(path))
+	require.Contains(t, again.jobs.interrupted, interrupted.ID)
+	out, err := again.dismiss(context.Background(), Request{Args: []string{"dismiss", interrupted.ID}})
+	require.NoError(t, err)
+	require.Equal(t, "Forgot interrupted job 2.", out)
+	require.Empty(t, again.jobs.interrupted)
+	out, err = again.dismiss(context.Background(), Request{Args: []string{"dismiss", interrupted.ID}})
+	require.NoError(t, err)
+	require.Contains(t, out, "No interrupted job")
+
+	// New jobs don't reuse the interrupted jobs' IDs
+	job := bot.Jobs().Start(Request{Args: []string{"date"}})
+	require.Equal(t, "3", job.ID)
+	bot.Jobs().Finish(job)
+
+	out, err = bot.rerun(context.Background(), Request{Args: []string{"rerun", "1"}})
+	require.NoError(t, err)
+	require.Contains(t, out, "No interrupted job")
+	out, err = bot.rerun(context.Background(), Request{Args: []string{"rerun", interrupted.ID}, Username: "bob"})
+	require.NoError(t, err)
+	require.Equal(t, "Running `build darwin` again.", out)
+	ran := <-got
+	require.Equal(t, []string{"build", "darwin"}, ran.Args)
+	require.Equal(t, "bob", ran.Username)
+	require.Empty(t, bot.jobs.interrupted)
+	require.Eventually(t, func() bool { return len(bot.Jobs().List()) == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestRestoreOldJobsFile(t *testing.T) {
+	// Before interrupted jobs were kept, the file only listed running jobs
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"ID":"7","Request":{"Args":["build"]}}]`), 0o600))
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	require.NoError(t, bot.RestoreJobs(path))
+	require.Contains(t, bot.jobs.interrupted, "7")
+	file, err := readJobsFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "7", file.Interrupted[0].ID)
+	require.Empty(t, file.Running)
+}
+
+func TestAuditLog(t *testing.T) {
+	bot, err := NewTestBot()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	require.NoError(t, bot.SetAuditLog(path))
+	done := make(chan struct{}, 2)
+	bot.AddCommand("release", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		done <- struct{}{}
+		return "", nil
+	}, "Release", bot.Config()))
+
+	require.NoError(t, bot.RunCommand(Request{Args: []string{"release", "promote", "1.0"}, Username: "alice", Backend: BackendSlack}))
+	require.NoError(t, bot.RunCommand(Request{Args: []string{"release", "broken", "1.0"}, Username: "bob", Backend: BackendKeybase}))
+	<-done
+	<-done
+	require.Eventually(t, func() bool {
+		records, err := readAudit(path, auditQuery{})
+		return err == nil && len(records) == 2
+	}, 5*time.Second, time.Millisecond)
+
+	now := time.Now()
+	q, err := parseAuditQuery([]string{"--user", "Alice", "--command", "release promote", "--since", "1h"}, now)
+	require.NoError(t, err)
+	records, err := readAudit(path, q)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, []string{"release", "promote", "1.0"}, records[0].Args)
+	require.Equal(t, AuditOK, records[0].Result)
+	require.True(t, records[0].DryRun)
+	require.NotEmpty(t, records[0].JobID)
+
+	q, err = parseAuditQuery([]string{"--until", "2015-01-01"}, now)
+	require.NoError(t, err)
+	records, err = readAudit(path, q)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	_, err = parseAuditQuery([]string{"--since", "yesterday"}, now)
+	require.Error(t, err)
+
+	out, err := bot.queryAudit(context.Background(), Request{Args: []string{"audit", "--limit", "1"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(out, "release "))
+}
+
+// newTestMember is a TestBackend standing in for the backend called name
+func newTestMember(name string) *TestBackend {
+	backend := NewTestBackend("testbot")
+	backend.Name = name
+	return backend
+}
+
+// newHybridTestBot listens, until the test ends, with a bot that has a whoami
+// command on a hybrid of slack, in builds, and keybase, in conv. setup, if
+// set, is called on the hybrid before the bot is made.
+func newHybridTestBot(t *testing.T, slack, keybase BotBackend, setup func(*HybridBackend)) (*Bot, *HybridBackend) {
+	backend := NewHybridBackend(
+		HybridBackendMember{Backend: slack, Channel: "builds"},
+		HybridBackendMember{Backend: keybase, Channel: "conv"},
+	)
+	if setup != nil {
+		setup(backend)
+	}
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.AddCommand("whoami", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		return req.Sender() + " on " + req.Backend, nil
+	}, "Who am I", bot.Config()))
+
+	listening := make(chan struct{})
+	go func() {
+		bot.Listen()
+		close(listening)
+	}()
+	t.Cleanup(func() {
+		backend.Stop()
+		for _, member := range []BotBackend{slack, keybase} {
+			member.(interface{ Disconnect() }).Disconnect()
+		}
+		select {
+		case <-listening:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Listen didn't return after stopping")
+		}
+	})
+	return bot, backend
+}
+
+func TestTestBackendConversation(t *testing.T) {
+	slack, keybase := newTestMember(BackendSlack), newTestMember(BackendKeybase)
+	bot, _ := newHybridTestBot(t, slack, keybase, nil)
+
+	// Replies go back where the command came from
+	keybase.Inject("conv", "alice", "!testbot whoami")
+	msg, err := keybase.WaitForMessage("alice on keybase", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "conv", msg.Channel)
+
+	slack.Inject("dm", "bob", "!otherbot whoami")
+	slack.Inject("dm", "bob", "!testbot help")
+	msg, err = slack.WaitForMessage("whoami", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "dm", msg.Channel)
+	require.Len(t, slack.Messages(), 1)
+	require.Len(t, keybase.Messages(), 1)
+
+	// Messages for a channel no member has, like a DM or another Keybase
+	// conversation, don't leak to every backend
+	bot.SendMessage("secret", "D123")
+	bot.Reply(Request{Backend: BackendIRC, Channel: "#builds"}, "secret")
+	require.Len(t, slack.Messages(), 1)
+	require.Len(t, keybase.Messages(), 1)
+
+	// Announcements go everywhere
+	bot.Broadcast("I'm running.")
+	msg, err = slack.WaitForMessage("I'm running.", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "builds", msg.Channel)
+	msg, err = keybase.WaitForMessage("I'm running.", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "conv", msg.Channel)
+	require.Equal(t, bot.AdvertisedCommands(), keybase.Advertisements())
+	require.Equal(t, keybase.Advertisements(), slack.Advertisements())
+}
+
+func TestHybridBridge(t *testing.T) {
+	slack, keybase := newTestMember(BackendSlack), newTestMember(BackendKeybase)
+	_, backend := newHybridTestBot(t, slack, keybase, func(backend *HybridBackend) {
+		backend.SetBridge(true)
+	})
+
+	slack.Inject("builds", "alice", "is the build green?")
+	msg, err := keybase.WaitForMessage("is the build green?", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, TestMessage{Channel: "conv", Text: "*alice* (slack): is the build green?"}, msg)
+
+	// Commands and the bot's replies show up on both sides
+	keybase.Inject("conv", "bob", "!testbot whoami")
+	_, err = slack.WaitForMessage("*bob* (keybase): !testbot whoami", 5*time.Second)
+	require.NoError(t, err)
+	_, err = slack.WaitForMessage("bob on keybase", 5*time.Second)
+	require.NoError(t, err)
+	_, err = keybase.WaitForMessage("bob on keybase", 5*time.Second)
+	require.NoError(t, err)
+
+	// Other channels aren't bridged
+	slack.Inject("random", "carol", "lunch?")
+	slack.Inject("random", "carol", "!testbot whoami")
+	_, err = slack.WaitForMessage("carol on slack", 5*time.Second)
+	require.NoError(t, err)
+	for _, msg := range keybase.Messages() {
+		require.NotContains(t, msg.Text, "carol")
+	}
+
+	backend.SetBridge(false)
+	slack.Inject("builds", "alice", "anyone there?")
+	slack.Inject("builds", "alice", "!testbot whoami")
+	_, err = slack.WaitForMessage("alice on slack", 5*time.Second)
+	require.NoError(t, err)
+	for _, msg := range keybase.Messages() {
+		require.NotContains(t, msg.Text, "anyone there?")
+		require.NotContains(t, msg.Text, "alice on slack")
+	}
+}
+
+// flakyBackend is a TestBackend whose first restart fails
+type flakyBackend struct {
+	*TestBackend
+	restarts atomic.Int32
+}
+
+func (b *flakyBackend) Restart() error {
+	if b.restarts.Add(1) == 1 {
+		return fmt.Errorf("keybase isn't running")
+	}
+	return nil
+}
+
+func TestHybridSupervisor(t *testing.T) {
+	slack := newTestMember(BackendSlack)
+	keybase := &flakyBackend{TestBackend: newTestMember(BackendKeybase)}
+	_, backend := newHybridTestBot(t, slack, keybase, func(backend *HybridBackend) {
+		backend.minBackoff, backend.maxBackoff, backend.healthyAfter = time.Millisecond, 10*time.Millisecond, 0
+	})
+
+	// The others hear about a member going down and coming back
+	keybase.Disconnect()
+	_, err := slack.WaitForMessage("Lost keybase (stopped listening), I'm trying to reconnect.", 5*time.Second)
+	require.NoError(t, err)
+	_, err = slack.WaitForMessage("keybase is back.", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), keybase.restarts.Load())
+	for _, health := range backend.Health() {
+		require.True(t, health.Healthy, "%s isn't healthy", health.Backend)
+	}
+	require.Empty(t, keybase.Messages())
+
+	keybase.Inject("conv", "alice", "!testbot whoami")
+	_, err = keybase.WaitForMessage("alice on keybase", 5*time.Second)
+	require.NoError(t, err)
+}
+
+func TestReactions(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	release := make(chan struct{})
+	bot.AddCommand("build", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		<-release
+		return "built", nil
+	}, "Build", bot.Config()))
+	bot.AddCommand("fail", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		return "", fmt.Errorf("failed")
+	}, "Fail", bot.Config()))
+	go bot.Listen()
+
+	reactions := func(id string, want ...string) {
+		require.Eventually(t, func() bool {
+			return slices.Equal(backend.Reactions(id), want)
+		}, 5*time.Second, time.Millisecond, "reactions on %s: %v", id, backend.Reactions(id))
+	}
+	build := backend.Inject("builds", "alice", "!testbot build")
+	reactions(build, ReactionReceived, ReactionRunning)
+	close(release)
+	reactions(build, ReactionReceived, ReactionSucceeded)
+
+	reactions(backend.Inject("builds", "alice", "!testbot fail"), ReactionReceived, ReactionFailed)
+	reactions(backend.Inject("builds", "alice", "!testbot nope"), ReactionReceived, ReactionFailed)
+	reactions(backend.Inject("builds", "alice", "not a command"))
+}
+
+func TestThreadReplies(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.SetThreadReplies(true)
+	bot.AddCommand("build", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		bot.Reply(req, "building")
+		return "built", nil
+	}, "Build", bot.Config()))
+	go bot.Listen()
+
+	build := backend.Inject("builds", "alice", "!testbot build")
+	summary, err := backend.WaitForMessage("Job 1 (`build`) for alice finished.", 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, TestMessage{Channel: "builds", Text: summary.Text}, summary)
+	for _, text := range []string{"building", "built"} {
+		msg, err := backend.WaitForMessage(text, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, TestMessage{Channel: "builds", Thread: build, Text: text}, msg)
+	}
+
+	// Builtins aren't jobs, so they answer in the channel
+	backend.Inject("builds", "alice", "!testbot help")
+	msg, err := backend.WaitForMessage("Build", 5*time.Second)
+	require.NoError(t, err)
+	require.Empty(t, msg.Thread)
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// slackMessageLimit is the longest message Slack shows without truncating
+	slackMessageLimit = 4000
+	// keybaseMessageLimit is the longest message Keybase accepts
+	keybaseMessageLimit = 10000
+)
+
+// codeFence starts and ends a code block
+const codeFence = "```"
+
+// messageLimiter is a backend that can only send messages up to a length
+type messageLimiter interface {
+	// messageLimit is the most bytes a reply to req can have, or 0 for no
+	// limit
+	messageLimit(req Request) int
+}
+
+// messageLimit is the most bytes a reply to req can have, or 0 for no limit
+func (b *Bot) messageLimit(req Request) int {
+	if l, ok := b.backend.(messageLimiter); ok {
+		return l.messageLimit(req)
+	}
+	return 0
+}
+
+// splitMessage splits text into messages of at most limit bytes, breaking
+// between lines where possible. A code block split across messages is closed
+// at the end of one and opened again at the start of the next, so each
+// message renders on its own.
+func splitMessage(text string, limit int) []string {
+	reopen, closing := codeFence+"\n", "\n"+codeFence
+	if limit <= len(reopen)+len(closing) || len(text) <= limit {
+		return []string{text}
+	}
+	var chunks []string
+	var chunk strings.Builder
+	inCode := false
+	// flush ends the current message, closing its code block if it's in one,
+	// and starts the next, reopening the code block if reopenCode is set
+	flush := func(reopenCode bool) {
+		s := strings.TrimSuffix(chunk.String(), "\n")
+		if inCode {
+			s += closing
+		}
+		chunks = append(chunks, s)
+		chunk.Reset()
+		if reopenCode {
+			chunk.WriteString(reopen)
+		}
+	}
+	// empty checks whether the current message has anything but a reopened
+	// code block
+	empty := func() bool {
+		return chunk.Len() == 0 || (inCode && chunk.Len() == len(reopen))
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		toggles := strings.Count(line, codeFence)%2 == 1
+		if inCode && toggles && strings.TrimSpace(line) == codeFence && chunk.Len()+len(line) > limit {
+			// The block ends here anyway, so end it with this message
+			flush(false)
+			inCode = false
+			continue
+		}
+		// Leave room to close a code block the line leaves open
+		reserve := 0
+		if inCode != toggles {
+			reserve = len(closing)
+		}
+		for rest := line; len(rest) > 0; {
+			room := limit - reserve - chunk.Len()
+			if len(rest) > room && !empty() {
+				flush(inCode)
+				continue
+			}
+			part := rest
+			if len(part) > room {
+				part = rest[:cutLine(rest, room)]
+			}
+			chunk.WriteString(part)
+			rest = rest[len(part):]
+		}
+		if toggles {
+			inCode = !inCode
+		}
+	}
+	if !empty() {
+		inCode = false
+		flush(false)
+	}
+	return chunks
+}
+
+// cutLine finds where to break a line longer than size: after the last space
+// that fits, or else at the last UTF-8 character that fits
+func cutLine(line string, size int) int {
+	if space := strings.LastIndexByte(line[:size], ' '); space > 0 {
+		return space + 1
+	}
+	cut := size
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	if cut == 0 {
+		return size
+	}
+	return cut
+}
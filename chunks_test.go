@@ -0,0 +1,75 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitMessage(t *testing.T) {
+	cases := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{"short", "hello", 20, []string{"hello"}},
+		{"no limit", strings.Repeat("a", 100), 0, []string{strings.Repeat("a", 100)}},
+		{"lines", "one two\nthree four\nfive six", 20, []string{"one two\nthree four", "five six"}},
+		{"long line", "aaaa bbbb cccc dddd eeee", 16, []string{"aaaa bbbb cccc ", "dddd eeee"}},
+		{"code block", "```\n1234\n5678\n9012\n```", 20, []string{"```\n1234\n5678\n```", "```\n9012\n```"}},
+		{"code block ending", "```\n1234\n5678\n```\nafter", 20, []string{"```\n1234\n5678\n```", "after"}},
+		{"unicode", "ééééééééé", 11, []string{"ééééé", "éééé"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chunks := splitMessage(c.text, c.limit)
+			require.Equal(t, c.want, chunks)
+			for _, chunk := range chunks {
+				if c.limit > 0 {
+					require.LessOrEqual(t, len(chunk), c.limit)
+				}
+				require.Zero(t, strings.Count(chunk, codeFence)%2, "unbalanced code block in %q", chunk)
+			}
+		})
+	}
+}
+
+func TestLongReplies(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	backend.Limit = 100
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.SetUploadThreshold(250)
+	var out string
+	bot.AddCommand("log", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		return BlockQuote(out), nil
+	}, "Log", bot.Config()))
+	go bot.Listen()
+
+	line := strings.Repeat("x", 30) + "\n"
+	out = strings.Repeat(line, 5)
+	backend.Inject("builds", "alice", "!testbot log")
+	require.Eventually(t, func() bool { return len(backend.Messages()) == 3 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, []TestMessage{
+		{Channel: "builds", Text: codeFence + "\n" + line + line + codeFence},
+		{Channel: "builds", Text: codeFence + "\n" + line + line + codeFence},
+		{Channel: "builds", Text: codeFence + "\n" + line + codeFence},
+	}, backend.Messages())
+
+	// Too long for messages, but the backend can't upload
+	out = strings.Repeat(line, 10)
+	backend.Inject("builds", "alice", "!testbot log")
+	require.Eventually(t, func() bool { return len(backend.Messages()) == 8 }, 5*time.Second, time.Millisecond)
+
+	backend.Uploads = true
+	backend.Inject("builds", "alice", "!testbot log")
+	msg, err := backend.WaitForMessage(out, 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, TestMessage{Channel: "builds", File: "log-3.txt", Text: out}, msg)
+}
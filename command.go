@@ -4,8 +4,11 @@
 package slackbot
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
+	"slices"
+	"strings"
 )
 
 // Command is the interface the bot uses to run things
@@ -15,6 +18,23 @@ type Command interface {
 	Description() string
 }
 
+// RequestCommand is a Command that wants the full Request it was invoked
+// with, rather than just the channel and args, and a context that is
+// cancelled when the job is cancelled or times out
+type RequestCommand interface {
+	Command
+	RunRequest(ctx context.Context, req Request) (string, error)
+}
+
+// runCommand runs a command with a request, falling back to Run for commands
+// that only take a channel and args
+func runCommand(ctx context.Context, command Command, req Request) (string, error) {
+	if rc, ok := command.(RequestCommand); ok {
+		return rc.RunRequest(ctx, req)
+	}
+	return command.Run(req.Channel, req.Args)
+}
+
 // execCommand is a Command that does an exec.Command(...) on the system
 type execCommand struct {
 	exec        string   // Command to execute
@@ -37,12 +57,17 @@ func NewExecCommand(exec string, args []string, showResult bool, description str
 
 // Run runs the exec command
 func (c execCommand) Run(_ string, _ []string) (string, error) {
+	return c.RunRequest(context.Background(), Request{})
+}
+
+// RunRequest runs the exec command, killing it if ctx is cancelled
+func (c execCommand) RunRequest(ctx context.Context, _ Request) (string, error) {
 	if c.config.DryRun() {
 		return fmt.Sprintf("I'm in dry run mode. I would have run `%s` with args: %s", c.exec, c.args), nil
 	}
 
-	//nolint:gosec,noctx // Command execution is the purpose of this bot, no context available
-	out, err := exec.Command(c.exec, c.args...).CombinedOutput()
+	//nolint:gosec // Command execution is the purpose of this bot
+	out, err := exec.CommandContext(ctx, c.exec, c.args...).CombinedOutput()
 	outAsString := string(out)
 	return outAsString, err
 }
@@ -86,3 +111,103 @@ func (c funcCommand) ShowResult() bool {
 func (c funcCommand) Description() string {
 	return c.desc
 }
+
+// RequestFn is the function that is run for a request command
+type RequestFn func(ctx context.Context, req Request) (string, error)
+
+// NewRequestFuncCommand creates a new function command that is passed the
+// full request
+func NewRequestFuncCommand(fn RequestFn, desc string, config Config) Command {
+	return requestFuncCommand{
+		fn:     fn,
+		desc:   desc,
+		config: config,
+	}
+}
+
+type requestFuncCommand struct {
+	desc   string
+	fn     RequestFn
+	config Config
+}
+
+func (c requestFuncCommand) Run(channel string, args []string) (string, error) {
+	return c.fn(context.Background(), NewRequest(channel, args))
+}
+
+func (c requestFuncCommand) RunRequest(ctx context.Context, req Request) (string, error) {
+	return c.fn(ctx, req)
+}
+
+func (c requestFuncCommand) ShowResult() bool {
+	return true
+}
+
+func (c requestFuncCommand) Description() string {
+	return c.desc
+}
+
+// DocumentCommand is a Command whose output is a Document, so it's rendered
+// for the backend the request came from
+type DocumentCommand interface {
+	Command
+	RunDocument(ctx context.Context, req Request) (Document, error)
+}
+
+// DocumentFn is the function that is run for a document command
+type DocumentFn func(ctx context.Context, req Request) (Document, error)
+
+// NewDocumentFuncCommand creates a new function command that returns a
+// Document
+func NewDocumentFuncCommand(fn DocumentFn, desc string, config Config) Command {
+	return documentFuncCommand{
+		fn:     fn,
+		desc:   desc,
+		config: config,
+	}
+}
+
+type documentFuncCommand struct {
+	desc   string
+	fn     DocumentFn
+	config Config
+}
+
+func (c documentFuncCommand) Run(channel string, args []string) (string, error) {
+	return c.RunRequest(context.Background(), NewRequest(channel, args))
+}
+
+func (c documentFuncCommand) RunRequest(ctx context.Context, req Request) (string, error) {
+	doc, err := c.fn(ctx, req)
+	return doc.Render(FormatPlain), err
+}
+
+func (c documentFuncCommand) RunDocument(ctx context.Context, req Request) (Document, error) {
+	return c.fn(ctx, req)
+}
+
+func (c documentFuncCommand) ShowResult() bool {
+	return true
+}
+
+func (c documentFuncCommand) Description() string {
+	return c.desc
+}
+
+// matchPath returns the longest key in paths that is a prefix of args, where
+// a key is a space separated trigger and subcommand path like "release promote"
+func matchPath[V any](args []string, paths map[string]V) (string, V, bool) {
+	var best string
+	var bestValue V
+	found := false
+	for path, value := range paths {
+		fields := strings.Fields(path)
+		if len(fields) == 0 || len(fields) > len(args) || (found && len(fields) <= len(strings.Fields(best))) {
+			continue
+		}
+		if slices.Equal(fields, args[:len(fields)]) {
+			best, bestValue, found = path, value, true
+		}
+	}
+	return best, bestValue, found
+}
@@ -22,6 +22,8 @@ type Config interface {
 	DryRun() bool
 	// SetDryRun changes dry run
 	SetDryRun(dryRun bool)
+	// Auth restricts who can run commands
+	Auth() AuthPolicy
 	// Save persists config
 	Save() error
 }
@@ -30,6 +32,7 @@ type config struct {
 	// These must be public for json serialization.
 	DryRunField bool
 	PausedField bool
+	AuthField   AuthPolicy
 }
 
 // Paused if paused
@@ -42,6 +45,11 @@ func (c config) DryRun() bool {
 	return c.DryRunField
 }
 
+// Auth returns the command authorization policy
+func (c config) Auth() AuthPolicy {
+	return c.AuthField
+}
+
 // SetPaused changes paused
 func (c *config) SetPaused(paused bool) {
 	c.PausedField = paused
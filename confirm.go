@@ -0,0 +1,164 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfirmationTTL is how long a dangerous command waits to be confirmed
+const ConfirmationTTL = 5 * time.Minute
+
+type confirmation struct {
+	token   string
+	req     Request
+	command Command
+	expires time.Time
+}
+
+// confirmations holds dangerous commands waiting to be confirmed
+type confirmations struct {
+	sync.Mutex
+	pending map[string]confirmation
+}
+
+func newConfirmations() *confirmations {
+	return &confirmations{pending: make(map[string]confirmation)}
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (c *confirmations) add(req Request, command Command, now time.Time) (confirmation, error) {
+	token, err := newToken()
+	if err != nil {
+		return confirmation{}, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.expireLocked(now)
+	conf := confirmation{token: token, req: req, command: command, expires: now.Add(ConfirmationTTL)}
+	c.pending[token] = conf
+	return conf, nil
+}
+
+// take removes and returns the confirmation for token, if it exists, hasn't
+// expired and was requested by the same sender as req
+func (c *confirmations) take(token string, req Request, now time.Time) (confirmation, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.expireLocked(now)
+	conf, ok := c.pending[token]
+	if !ok {
+		return confirmation{}, fmt.Errorf("No pending command with token `%s`, it may have expired", token)
+	}
+	if !sameSender(conf.req, req) {
+		return confirmation{}, fmt.Errorf("Only %s can confirm `%s`", conf.req.Sender(), token)
+	}
+	delete(c.pending, token)
+	return conf, nil
+}
+
+func (c *confirmations) list(now time.Time) []confirmation {
+	c.Lock()
+	defer c.Unlock()
+	c.expireLocked(now)
+	confs := make([]confirmation, 0, len(c.pending))
+	for _, conf := range c.pending {
+		confs = append(confs, conf)
+	}
+	sort.Slice(confs, func(i, j int) bool { return confs[i].expires.Before(confs[j].expires) })
+	return confs
+}
+
+func (c *confirmations) expireLocked(now time.Time) {
+	for token, conf := range c.pending {
+		if now.After(conf.expires) {
+			log.Printf("Confirmation %s for %q expired", token, conf.req.Args)
+			delete(c.pending, token)
+		}
+	}
+}
+
+func sameSender(a, b Request) bool {
+	return a.Backend == b.Backend && a.UserID == b.UserID && a.Username == b.Username
+}
+
+// commandLine formats args the way they would be typed, quoting where needed
+func commandLine(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// requestConfirmation asks the sender to confirm req, returning the message
+// it sent
+func (b *Bot) requestConfirmation(req Request, command Command) string {
+	// The request is finished as far as its sender is concerned; the confirmed
+	// command is a new one
+	req.Started, req.Done = nil, nil
+	conf, err := b.confirmations.add(req, command, time.Now())
+	if err != nil {
+		log.Printf("Error creating confirmation: %s", err)
+		msg := fmt.Sprintf("I couldn't create a confirmation token: %s", err)
+		b.Reply(req, msg)
+		return msg
+	}
+	msg := fmt.Sprintf("%s, this will run:\n%s\nTo go ahead, send `!%s confirm %s` within %s.",
+		req.Sender(), BlockQuote("!"+b.name+" "+commandLine(req.Args)), b.name, conf.token, ConfirmationTTL)
+	b.Reply(req, msg)
+	return msg
+}
+
+func (b *Bot) confirm(_ context.Context, req Request) (string, error) {
+	if len(req.Args) != 2 {
+		return fmt.Sprintf("Usage: `!%s confirm <token>`", b.name), nil
+	}
+	if b.Config().Paused() {
+		return "I can't do that, I'm paused.", nil
+	}
+	conf, err := b.confirmations.take(req.Args[1], req, time.Now())
+	if err != nil {
+		return err.Error(), nil
+	}
+	log.Printf("Confirmed %q for %s (%s)", conf.req.Args, req.Sender(), req.Backend)
+	go b.run(conf.req, conf.command)
+	return fmt.Sprintf("Confirmed, running `%s`.", commandLine(conf.req.Args)), nil
+}
+
+func (b *Bot) listPending(context.Context, Request) (string, error) {
+	confs := b.confirmations.list(time.Now())
+	if len(confs) == 0 {
+		return "Nothing is waiting to be confirmed.", nil
+	}
+	rows := [][]string{{"Token", "User", "Command", "Expires in"}}
+	for _, conf := range confs {
+		rows = append(rows, []string{conf.token, conf.req.Sender(), commandLine(conf.req.Args),
+			time.Until(conf.expires).Round(time.Second).String()})
+	}
+	table, err := formatTable(rows)
+	if err != nil {
+		return "", err
+	}
+	return BlockQuote(table), nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// Format is the markup a backend's messages are written in
+type Format int
+
+const (
+	// FormatPlain is text without markup, for IRC and terminals
+	FormatPlain Format = iota
+	// FormatSlack is Slack's mrkdwn
+	FormatSlack
+	// FormatKeybase is Keybase's markdown
+	FormatKeybase
+)
+
+// Document is a message made of blocks, which each backend renders in its own
+// markup. Commands can return one with NewDocumentFuncCommand.
+type Document []Block
+
+// Block is a paragraph, code block or table in a Document
+type Block interface {
+	render(format Format) string
+}
+
+// Inline is a piece of text in a Paragraph
+type Inline interface {
+	render(format Format) string
+}
+
+// Paragraph is a block of text
+type Paragraph []Inline
+
+// CodeBlock is preformatted text, like command output
+type CodeBlock string
+
+// Table is rows of cells, the first row being the header. Backends with
+// proportional fonts show each row on its own line, rather than aligning the
+// columns.
+type Table [][]string
+
+// Text is plain text
+type Text string
+
+// Emphasis is emphasized (italic) text
+type Emphasis string
+
+// Strong is strongly emphasized (bold) text
+type Strong string
+
+// Code is inline code
+type Code string
+
+// Link links to a URL, with Text or else the URL as its text
+type Link struct {
+	URL  string
+	Text string
+}
+
+// Mention mentions a user, by ID on Slack and by username elsewhere
+type Mention struct {
+	UserID   string
+	Username string
+}
+
+// Render renders d in a markup
+func (d Document) Render(format Format) string {
+	blocks := make([]string, 0, len(d))
+	for _, block := range d {
+		if s := block.render(format); s != "" {
+			blocks = append(blocks, s)
+		}
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+// slackBlocks renders d as Slack Block Kit blocks, one mrkdwn section per
+// block, returning false if d is too big for Block Kit
+func (d Document) slackBlocks() ([]map[string]any, bool) {
+	const maxBlocks, maxSectionText = 50, 3000
+	if len(d) > maxBlocks {
+		return nil, false
+	}
+	blocks := make([]map[string]any, 0, len(d))
+	for _, block := range d {
+		text := block.render(FormatSlack)
+		if text == "" {
+			continue
+		}
+		if len(text) > maxSectionText {
+			return nil, false
+		}
+		blocks = append(blocks, map[string]any{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		})
+	}
+	return blocks, true
+}
+
+func (p Paragraph) render(format Format) string {
+	var buf strings.Builder
+	for _, inline := range p {
+		buf.WriteString(inline.render(format))
+	}
+	return buf.String()
+}
+
+func (c CodeBlock) render(format Format) string {
+	if c == "" {
+		return ""
+	}
+	if format == FormatPlain {
+		return strings.TrimSuffix(string(c), "\n")
+	}
+	return BlockQuote(Text(c).render(format))
+}
+
+func (t Table) render(format Format) string {
+	if len(t) == 0 {
+		return ""
+	}
+	if format == FormatPlain {
+		table, err := formatTable(t)
+		if err != nil {
+			log.Printf("Error formatting table: %s", err)
+		}
+		return strings.TrimSuffix(table, "\n")
+	}
+	header, rows := t[0], t[1:]
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		line := "• " + Strong(row[0]).render(format)
+		var cells []string
+		for i, cell := range row[1:] {
+			// With more than two columns, say which each cell is
+			if len(row) > 2 && i+1 < len(header) {
+				cell = header[i+1] + ": " + cell
+			}
+			cells = append(cells, Text(cell).render(format))
+		}
+		if len(cells) > 0 {
+			line += " — " + strings.Join(cells, ", ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slackEscaper escapes the characters Slack treats as markup in text
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (t Text) render(format Format) string {
+	if format == FormatSlack {
+		return slackEscaper.Replace(string(t))
+	}
+	return string(t)
+}
+
+func (e Emphasis) render(format Format) string {
+	return wrap(format, "_", Text(e).render(format))
+}
+
+func (s Strong) render(format Format) string {
+	return wrap(format, "*", Text(s).render(format))
+}
+
+func (c Code) render(format Format) string {
+	return wrap(format, "`", Text(c).render(format))
+}
+
+// wrap puts markup around text, except in plain text
+func wrap(format Format, markup, text string) string {
+	if format == FormatPlain || text == "" {
+		return text
+	}
+	return markup + text + markup
+}
+
+func (l Link) render(format Format) string {
+	switch {
+	case format == FormatSlack && l.Text != "":
+		return "<" + l.URL + "|" + Text(l.Text).render(format) + ">"
+	case format == FormatSlack:
+		return "<" + l.URL + ">"
+	case l.Text == "" || l.Text == l.URL:
+		return l.URL
+	default:
+		return l.Text + " (" + l.URL + ")"
+	}
+}
+
+func (m Mention) render(format Format) string {
+	switch {
+	case format == FormatSlack && m.UserID != "":
+		return "<@" + m.UserID + ">"
+	case m.Username != "":
+		return "@" + m.Username
+	default:
+		return "@" + m.UserID
+	}
+}
+
+// formatter is a backend that knows the markup its messages are written in
+type formatter interface {
+	messageFormat(req Request) Format
+}
+
+// blockSender is a backend that can send Slack Block Kit blocks
+type blockSender interface {
+	// sendBlocks sends blocks to req's channel, in req's thread if it has
+	// one, with text for notifications and clients that don't show blocks
+	sendBlocks(req Request, blocks []map[string]any, text string) error
+}
+
+// errBlocksUnsupported means a backend can't send blocks where a request came
+// from, so the document is sent as text instead
+var errBlocksUnsupported = errors.New("Blocks aren't supported")
+
+// messageFormat is the markup of replies to req
+func (b *Bot) messageFormat(req Request) Format {
+	if f, ok := b.backend.(formatter); ok {
+		return f.messageFormat(req)
+	}
+	return FormatPlain
+}
+
+// ReplyDocument sends doc back to where req came from, rendered for the
+// backend that received it: as Block Kit blocks where the backend can send
+// them, and otherwise in the backend's markup, like Reply
+func (b *Bot) ReplyDocument(req Request, doc Document) {
+	if s, ok := b.backend.(blockSender); ok {
+		if blocks, ok := doc.slackBlocks(); ok {
+			blockReq := req
+			blockReq.ThreadID = ""
+			if b.threaded(req) {
+				blockReq.ThreadID = threadOf(req)
+			}
+			err := s.sendBlocks(blockReq, blocks, doc.Render(FormatSlack))
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, errBlocksUnsupported) {
+				log.Printf("Error sending blocks, sending text: %s", err)
+			}
+		}
+	}
+	b.Reply(req, doc.Render(b.messageFormat(req)))
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocumentRender(t *testing.T) {
+	doc := Document{
+		Paragraph{Text("Build "), Strong("1 & 2"), Text(" for "), Mention{UserID: "U1", Username: "alice"},
+			Text(" is "), Emphasis("done"), Text(", see "), Link{URL: "https://ci/1", Text: "CI"}, Text(" or run "), Code("!bot log")},
+		CodeBlock("out <1>\n"),
+		Table{{"Job", "User", "Command"}, {"1", "alice", "build"}, {"2", "bob", "test"}},
+	}
+	require.Equal(t, "Build 1 & 2 for @alice is done, see CI (https://ci/1) or run !bot log\n\n"+
+		"out <1>\n\n"+
+		"Job     User    Command\n"+
+		"1       alice   build\n"+
+		"2       bob     test", doc.Render(FormatPlain))
+	require.Equal(t, "Build *1 &amp; 2* for <@U1> is _done_, see <https://ci/1|CI> or run `!bot log`\n\n"+
+		"```\nout &lt;1&gt;\n```\n\n"+
+		"• *1* — User: alice, Command: build\n"+
+		"• *2* — User: bob, Command: test", doc.Render(FormatSlack))
+	require.Equal(t, "Build *1 & 2* for @alice is _done_, see CI (https://ci/1) or run `!bot log`\n\n"+
+		"```\nout <1>\n```\n\n"+
+		"• *1* — User: alice, Command: build\n"+
+		"• *2* — User: bob, Command: test", doc.Render(FormatKeybase))
+
+	help := Document{Table{{"Command", "Description"}, {"build", "Build things"}}}
+	require.Equal(t, "• *build* — Build things", help.Render(FormatKeybase))
+}
+
+func TestDocumentCommand(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	backend.Format = FormatKeybase
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.AddCommand("status", NewDocumentFuncCommand(func(_ context.Context, req Request) (Document, error) {
+		return Document{Paragraph{Text("All good, "), Strong(req.Username)}}, nil
+	}, "Show the status", bot.Config()))
+	go bot.Listen()
+
+	backend.Inject("builds", "alice", "!testbot status")
+	_, err := backend.WaitForMessage("All good, *alice*", 5*time.Second)
+	require.NoError(t, err)
+	backend.Inject("builds", "alice", "!testbot help")
+	_, err = backend.WaitForMessage("• *status* — Show the status", 5*time.Second)
+	require.NoError(t, err)
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import "errors"
+
+// MessageHandle identifies a message the bot sent, so it can be edited
+type MessageHandle struct {
+	// Backend is the BackendName of the backend that sent the message
+	Backend string
+	Channel string
+	ID      string
+}
+
+// Valid checks whether the handle identifies a message. Backends that can't
+// tell which message they sent return an empty handle.
+func (h MessageHandle) Valid() bool {
+	return h.ID != ""
+}
+
+// MessageEditor is a backend that can edit messages it sent
+type MessageEditor interface {
+	EditMessage(handle MessageHandle, text string) error
+}
+
+// ErrEditsUnsupported means a backend can't edit a message
+var ErrEditsUnsupported = errors.New("Editing messages isn't supported")
+
+// EditMessage replaces the text of a message the bot sent
+func (b *Bot) EditMessage(handle MessageHandle, text string) error {
+	e, ok := b.backend.(MessageEditor)
+	if !ok || !handle.Valid() {
+		return ErrEditsUnsupported
+	}
+	return e.EditMessage(handle, text)
+}
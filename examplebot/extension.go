@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 
 	"github.com/keybase/slackbot"
@@ -14,7 +15,7 @@ import (
 
 type extension struct{}
 
-func (e *extension) Run(bot *slackbot.Bot, _ string, args []string) (string, error) {
+func (e *extension) Run(_ context.Context, bot *slackbot.Bot, req slackbot.Request) (string, error) {
 	app := kingpin.New("examplebot", "Kingpin extension")
 	app.Terminate(nil)
 	stringBuffer := new(bytes.Buffer)
@@ -23,7 +24,7 @@ func (e *extension) Run(bot *slackbot.Bot, _ string, args []string) (string, err
 	testCmd := app.Command("echo", "Echo")
 	testCmdEchoFlag := testCmd.Flag("output", "Output to echo").Required().String()
 
-	cmd, usage, cmdErr := cli.Parse(app, args, stringBuffer)
+	cmd, usage, cmdErr := cli.Parse(app, req.Args, stringBuffer)
 	if usage != "" || cmdErr != nil {
 		return usage, cmdErr
 	}
@@ -39,7 +40,7 @@ func (e *extension) Run(bot *slackbot.Bot, _ string, args []string) (string, err
 }
 
 func (e *extension) Help(bot *slackbot.Bot) string {
-	out, err := e.Run(bot, "", nil)
+	out, err := e.Run(context.Background(), bot, slackbot.Request{})
 	if err != nil {
 		return fmt.Sprintf("Error getting help: %s", err)
 	}
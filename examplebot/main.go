@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/keybase/slackbot"
@@ -11,9 +12,15 @@ import (
 
 func main() {
 	config := slackbot.NewConfig(false, false)
-	backend, err := slackbot.NewSlackBotBackend(slackbot.GetTokenFromEnv())
-	if err != nil {
-		log.Fatal(err)
+	// Set SLACKBOT_REPL=1 to try the bot out in a terminal instead of Slack
+	var backend slackbot.BotBackend
+	if repl, ok := slackbot.NewREPLBackendFromEnv("examplebot"); ok {
+		backend = repl
+	} else {
+		var err error
+		if backend, err = slackbot.NewSlackBackendFromEnv(); err != nil {
+			log.Fatal(err)
+		}
 	}
 	bot := slackbot.NewBot(config, "examplebot", "", backend)
 
@@ -28,11 +35,11 @@ func main() {
 
 	// Extension as default command with help
 	ext := &extension{}
-	runFn := func(channel string, args []string) (string, error) {
-		return ext.Run(bot, channel, args)
+	runFn := func(ctx context.Context, req slackbot.Request) (string, error) {
+		return ext.Run(ctx, bot, req)
 	}
-	bot.SetDefault(slackbot.NewFuncCommand(runFn, "Extension", bot.Config()))
-	bot.SetHelp(bot.HelpMessage() + "\n\n" + ext.Help(bot))
+	bot.SetDefault(slackbot.NewRequestFuncCommand(runFn, "Extension", bot.Config()))
+	bot.SetHelpDocument(append(bot.HelpDocument(), slackbot.CodeBlock(ext.Help(bot))))
 
 	// Connect to slack and listen
 	bot.Listen()
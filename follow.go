@@ -0,0 +1,264 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFollowInterval is how often a followed job's log is posted, at most
+const DefaultFollowInterval = 10 * time.Second
+
+const (
+	// followLines is how many lines of a followed log are shown
+	followLines = 20
+	// maxFollowRead is the most of a log read at a time, so a job that logs a
+	// lot between updates doesn't have all of it read just to show the end
+	maxFollowRead = 64 * 1024
+)
+
+// SetFollowInterval sets how often a followed job's log is posted, at most
+func (b *Bot) SetFollowInterval(interval time.Duration) {
+	b.followInterval = interval
+}
+
+// followKey is a job being followed in a channel
+type followKey struct {
+	jobID   string
+	backend string
+	channel string
+}
+
+// follower posts a job's log, until it's stopped
+type follower struct {
+	stop context.CancelFunc
+}
+
+// follows are the jobs whose logs are being posted, see !bot follow
+type follows struct {
+	sync.Mutex
+	followers map[followKey]*follower
+}
+
+func newFollows() *follows {
+	return &follows{followers: make(map[followKey]*follower)}
+}
+
+// add starts following a job, returning false if it's already followed
+func (f *follows) add(key followKey, fl *follower) bool {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.followers[key]; ok {
+		return false
+	}
+	f.followers[key] = fl
+	return true
+}
+
+// done forgets a follower that stopped on its own
+func (f *follows) done(key followKey, fl *follower) {
+	f.Lock()
+	defer f.Unlock()
+	if f.followers[key] == fl {
+		delete(f.followers, key)
+	}
+}
+
+// remove stops following the jobs in a channel matching jobID, or every job
+// in the channel if jobID is empty, returning the IDs of the jobs
+func (f *follows) remove(backend, channel, jobID string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var ids []string
+	for key, fl := range f.followers {
+		if key.backend != backend || key.channel != channel || (jobID != "" && key.jobID != jobID) {
+			continue
+		}
+		fl.stop()
+		delete(f.followers, key)
+		ids = append(ids, key.jobID)
+	}
+	return ids
+}
+
+func (b *Bot) followJob(_ context.Context, req Request) (string, error) {
+	if len(req.Args) != 2 {
+		return fmt.Sprintf("Usage: `!%s follow <job id>`", b.name), nil
+	}
+	job, ok := b.jobs.Get(req.Args[1])
+	if !ok {
+		return fmt.Sprintf("No job with ID %s, see `!%s jobs`", req.Args[1], b.name), nil
+	}
+	path := job.Log()
+	if path == "" {
+		return fmt.Sprintf("Job %s (`%s`) doesn't have a log to follow.", job.ID, commandLine(job.Request.Args)), nil
+	}
+	key := followKey{jobID: job.ID, backend: req.Backend, channel: req.Channel}
+	ctx, stop := context.WithCancel(job.Context())
+	fl := &follower{stop: stop}
+	if !b.follows.add(key, fl) {
+		stop()
+		return fmt.Sprintf("Already following job %s here.", job.ID), nil
+	}
+	go func() {
+		defer b.follows.done(key, fl)
+		defer stop()
+		b.follow(ctx, job, path, req)
+	}()
+	return fmt.Sprintf("Following job %s (`%s`). To stop run `!%s unfollow %s`.",
+		job.ID, commandLine(job.Request.Args), b.name, job.ID), nil
+}
+
+func (b *Bot) unfollowJob(_ context.Context, req Request) (string, error) {
+	if len(req.Args) > 2 {
+		return fmt.Sprintf("Usage: `!%s unfollow [<job id>]`", b.name), nil
+	}
+	var jobID string
+	if len(req.Args) == 2 {
+		jobID = req.Args[1]
+	}
+	ids := b.follows.remove(req.Backend, req.Channel, jobID)
+	switch {
+	case len(ids) == 0 && jobID != "":
+		return fmt.Sprintf("Job %s isn't being followed here.", jobID), nil
+	case len(ids) == 0:
+		return "Nothing is being followed here.", nil
+	}
+	return fmt.Sprintf("Stopped following job %s.", strings.Join(ids, ", ")), nil
+}
+
+// follow posts the end of a job's log to where req came from as the log
+// grows, at most once per follow interval, until ctx is done. Backends that
+// can edit messages get one message that's kept up to date; others get a
+// message with the new lines each time.
+func (b *Bot) follow(ctx context.Context, job *Job, path string, req Request) {
+	interval := b.followInterval
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	tail := &logTail{path: path}
+	var shown []string
+	var handle MessageHandle
+	update := func() {
+		lines, err := tail.read()
+		if err != nil {
+			log.Printf("Error reading log of job %s: %s", job.ID, err)
+			return
+		}
+		if len(lines) == 0 {
+			return
+		}
+		shown = lastLines(append(shown, lines...), followLines)
+		text := followText(job, shown)
+		// Drop lines until it fits in one message, since it's edited in place
+		for limit := b.messageLimit(req); limit > 0 && len(text) > limit && len(shown) > 1; {
+			shown = shown[1:]
+			text = followText(job, shown)
+		}
+		if handle.Valid() {
+			err := b.EditMessage(handle, text)
+			if err == nil {
+				return
+			}
+			log.Printf("Error editing log of job %s: %s", job.ID, err)
+		}
+		handle = b.replyMessage(req, text)
+		if !handle.Valid() {
+			// Without edits, each message has only what's new
+			shown = nil
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if job.Context().Err() != nil {
+				// The job finished, so show how its log ends
+				update()
+			}
+			return
+		case <-ticker.C:
+			update()
+		}
+	}
+}
+
+// followText shows the end of a job's log
+func followText(job *Job, lines []string) string {
+	return fmt.Sprintf("Log of job %s (`%s`):\n%s", job.ID, commandLine(job.Request.Args),
+		BlockQuote(strings.Join(lines, "\n")))
+}
+
+// lastLines returns the last n of lines
+func lastLines(lines []string, n int) []string {
+	if len(lines) > n {
+		return lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// logTail reads the lines added to a log file since it was last read
+type logTail struct {
+	path   string
+	offset int64
+}
+
+// read returns the complete lines added to the log since the last read, or
+// the last of them if there are a lot. A log that doesn't exist yet has no
+// lines, and one that got shorter is read from the start again.
+func (t *logTail) read() ([]string, error) {
+	f, err := os.Open(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < t.offset {
+		t.offset = 0
+	}
+	start, skipPartial := t.offset, false
+	if size-start > maxFollowRead {
+		start, skipPartial = size-maxFollowRead, true
+	}
+	buf := make([]byte, size-start)
+	if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	// Leave a line that's still being written for next time
+	end := bytes.LastIndexByte(buf, '\n')
+	if end < 0 {
+		return nil, nil
+	}
+	t.offset = start + int64(end) + 1
+	buf = buf[:end]
+	if skipPartial {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			return nil, nil
+		}
+		buf = buf[i+1:]
+	}
+	lines := strings.Split(string(buf), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lastLines(lines, followLines), nil
+}
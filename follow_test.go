@@ -0,0 +1,127 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func appendLog(t *testing.T, path, text string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(text)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build.log")
+	tail := &logTail{path: path}
+	lines, err := tail.read()
+	require.NoError(t, err)
+	require.Empty(t, lines)
+
+	appendLog(t, path, "one\r\ntwo\nthr")
+	lines, err = tail.read()
+	require.NoError(t, err)
+	require.Equal(t, []string{"one", "two"}, lines)
+
+	// The partial line is read once it's finished
+	appendLog(t, path, "ee\n")
+	lines, err = tail.read()
+	require.NoError(t, err)
+	require.Equal(t, []string{"three"}, lines)
+
+	// A log that's started again is read from the start
+	require.NoError(t, os.WriteFile(path, []byte("again\n"), 0600))
+	lines, err = tail.read()
+	require.NoError(t, err)
+	require.Equal(t, []string{"again"}, lines)
+
+	// Only the end of a lot of output is read
+	appendLog(t, path, strings.Repeat(strings.Repeat("x", 99)+"\n", 2*maxFollowRead/100)+"last\n")
+	lines, err = tail.read()
+	require.NoError(t, err)
+	require.Len(t, lines, followLines)
+	require.Equal(t, "last", lines[len(lines)-1])
+}
+
+func TestFollowJob(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.SetFollowInterval(10 * time.Millisecond)
+	path := filepath.Join(t.TempDir(), "build.log")
+	done := make(chan struct{})
+	bot.AddCommand("build", NewRequestFuncCommand(func(ctx context.Context, req Request) (string, error) {
+		job, _ := bot.Jobs().Get(req.JobID)
+		job.SetLog(path)
+		<-done
+		return "built", nil
+	}, "Build", bot.Config()))
+	bot.AddCommand("deploy", NewRequestFuncCommand(func(ctx context.Context, req Request) (string, error) {
+		<-done
+		return "deployed", nil
+	}, "Deploy", bot.Config()))
+	go bot.Listen()
+	logMessages := func() []TestMessage {
+		var messages []TestMessage
+		for _, msg := range backend.Messages() {
+			if strings.HasPrefix(msg.Text, "Log of job 1") {
+				messages = append(messages, msg)
+			}
+		}
+		return messages
+	}
+
+	backend.Inject("builds", "alice", "!testbot build")
+	require.Eventually(t, func() bool {
+		jobs := bot.Jobs().List()
+		return len(jobs) == 1 && jobs[0].Log() != ""
+	}, 5*time.Second, time.Millisecond)
+	backend.Inject("builds", "alice", "!testbot deploy")
+	require.Eventually(t, func() bool { return len(bot.Jobs().List()) == 2 }, 5*time.Second, time.Millisecond)
+	backend.Inject("builds", "bob", "!testbot follow 2")
+	_, err := backend.WaitForMessage("Job 2 (`deploy`) doesn't have a log to follow.", 5*time.Second)
+	require.NoError(t, err)
+
+	backend.Inject("builds", "bob", "!testbot follow 1")
+	_, err = backend.WaitForMessage("Following job 1 (`build`).", 5*time.Second)
+	require.NoError(t, err)
+	backend.Inject("builds", "bob", "!testbot follow 1")
+	_, err = backend.WaitForMessage("Already following job 1 here.", 5*time.Second)
+	require.NoError(t, err)
+
+	appendLog(t, path, "one\ntwo\n")
+	_, err = backend.WaitForMessage("Log of job 1 (`build`):\n"+BlockQuote("one\ntwo"), 5*time.Second)
+	require.NoError(t, err)
+	// New lines edit the same message
+	appendLog(t, path, "three\n")
+	_, err = backend.WaitForMessage(BlockQuote("one\ntwo\nthree"), 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, logMessages(), 1)
+
+	backend.Inject("builds", "bob", "!testbot unfollow 1")
+	_, err = backend.WaitForMessage("Stopped following job 1.", 5*time.Second)
+	require.NoError(t, err)
+	backend.Inject("builds", "bob", "!testbot unfollow")
+	_, err = backend.WaitForMessage("Nothing is being followed here.", 5*time.Second)
+	require.NoError(t, err)
+
+	// Following again starts with the end of the log, and shows how it ends
+	// when the job finishes
+	backend.Inject("builds", "carol", "!testbot follow 1")
+	require.Eventually(t, func() bool { return len(backend.Messages()) == 7 }, 5*time.Second, time.Millisecond)
+	appendLog(t, path, "four\n")
+	close(done)
+	_, err = backend.WaitForMessage(BlockQuote("one\ntwo\nthree\nfour"), 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, logMessages(), 2)
+}
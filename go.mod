@@ -7,6 +7,8 @@ toolchain go1.25.5
 require (
 	github.com/keybase/go-keybase-chat-bot v0.0.0-20260127182354-7367dd3315a3
 	github.com/nlopes/slack v0.1.1-0.20180101221843-107290b5bbaf
+	github.com/stretchr/testify v1.11.1
+	golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
 
@@ -17,8 +19,6 @@ require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.11.1 // indirect
-	golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -1,23 +1,63 @@
 package slackbot
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
+// chatObserver is a BotCommandRunner that also wants the messages people
+// send that aren't commands
+type chatObserver interface {
+	ObserveMessage(msg ChatMessage)
+}
+
+// observeMessage passes msg to runner, if it wants it
+func observeMessage(runner BotCommandRunner, msg ChatMessage) {
+	if observer, ok := runner.(chatObserver); ok {
+		observer.ObserveMessage(msg)
+	}
+}
+
+// channelResolver is a backend whose channels have IDs as well as names
+type channelResolver interface {
+	channelID(name string) string
+}
+
 type hybridRunner struct {
-	runner  BotCommandRunner
-	channel string
+	runner BotCommandRunner
+	hybrid *HybridBackend
+	member int
 }
 
-func newHybridRunner(runner BotCommandRunner, channel string) *hybridRunner {
+func newHybridRunner(runner BotCommandRunner, hybrid *HybridBackend, member int) *hybridRunner {
 	return &hybridRunner{
-		runner:  runner,
-		channel: channel,
+		runner: runner,
+		hybrid: hybrid,
+		member: member,
+	}
+}
+
+// RunCommand runs req, giving it the member's channel if its backend doesn't
+// have channels
+func (r *hybridRunner) RunCommand(req Request) error {
+	if req.Channel == "" {
+		req.Channel = r.hybrid.backends[r.member].Channel
 	}
+	return r.runner.RunCommand(req)
 }
 
-func (r *hybridRunner) RunCommand(args []string, _ string) error {
-	return r.runner.RunCommand(args, r.channel)
+// ObserveMessage mirrors messages in the member's channel to the others, when
+// bridging
+func (r *hybridRunner) ObserveMessage(msg ChatMessage) {
+	if !r.hybrid.Bridging() || !r.hybrid.backends[r.member].isChannel(msg.Channel) {
+		return
+	}
+	r.hybrid.mirror(r.member, fmt.Sprintf("*%s* (%s): %s", msg.Sender(), msg.Backend, msg.Text))
 }
 
 type HybridBackendMember struct {
@@ -25,30 +65,261 @@ type HybridBackendMember struct {
 	Channel string
 }
 
+// isChannel checks whether channel, a name or ID, is the member's channel
+func (m HybridBackendMember) isChannel(channel string) bool {
+	if m.Channel == "" || channel == "" {
+		return false
+	}
+	if channel == m.Channel {
+		return true
+	}
+	resolver, ok := m.Backend.(channelResolver)
+	return ok && resolver.channelID(m.Channel) == channel
+}
+
 type HybridBackend struct {
 	backends []HybridBackendMember
+
+	// How long to wait before restarting a member that stopped listening,
+	// doubling up to maxBackoff, and how long it has to keep listening to
+	// count as healthy again
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	healthyAfter time.Duration
+
+	mu       sync.Mutex
+	bridge   bool
+	health   []MemberHealth
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 func NewHybridBackend(backends ...HybridBackendMember) *HybridBackend {
-	return &HybridBackend{
-		backends: backends,
+	b := &HybridBackend{
+		backends:     backends,
+		minBackoff:   time.Second,
+		maxBackoff:   5 * time.Minute,
+		healthyAfter: 30 * time.Second,
+		health:       make([]MemberHealth, len(backends)),
+		stop:         make(chan struct{}),
+	}
+	for i := range backends {
+		b.health[i] = MemberHealth{Backend: b.memberName(i), Channel: backends[i].Channel, Healthy: true}
+	}
+	return b
+}
+
+// SetBridge turns bridging on or off. When bridging, messages people send in
+// a member's channel are mirrored to the other members' channels, with who
+// sent them, and so are the bot's replies there.
+func (b *HybridBackend) SetBridge(enabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bridge = enabled
+}
+
+// Bridging returns whether members' channels are bridged
+func (b *HybridBackend) Bridging() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bridge
+}
+
+// mirror sends text to every member's channel except from's
+func (b *HybridBackend) mirror(from int, text string) {
+	for i, backend := range b.backends {
+		if i != from && backend.Channel != "" {
+			backend.Backend.SendMessage(text, backend.Channel)
+		}
+	}
+}
+
+// SendMessage sends text to the member whose channel is channel. Messages for
+// a channel no member has are dropped rather than sent everywhere, since they
+// may be meant for one conversation; announcements go through Broadcast.
+func (b *HybridBackend) SendMessage(text string, channel string) MessageHandle {
+	if channel != "" {
+		for i, backend := range b.backends {
+			if backend.isChannel(channel) {
+				return b.send(i, text, Request{Channel: channel})
+			}
+		}
+	}
+	log.Printf("No member has channel %q, dropping message", channel)
+	return MessageHandle{}
+}
+
+// send sends text to req's channel on a member, as a reply if the member
+// has its own way to reply, mirroring it if the channel is bridged. The handle
+// is of the member's message; mirrored copies aren't edited.
+func (b *HybridBackend) send(member int, text string, req Request) MessageHandle {
+	backend := b.backends[member]
+	var handle MessageHandle
+	if r, ok := backend.Backend.(replier); ok {
+		handle = r.Reply(req, text)
+	} else {
+		handle = backend.Backend.SendMessage(text, req.Channel)
+	}
+	if b.Bridging() && backend.isChannel(req.Channel) {
+		b.mirror(member, text)
+	}
+	return handle
+}
+
+// Broadcast sends text to every member's channel. Members without a channel,
+// like the webhook, are skipped.
+func (b *HybridBackend) Broadcast(text string) {
+	b.mirror(-1, text)
+}
+
+// Reply sends text to the member that received req, in the channel req came
+// from. Replies to requests from a backend that isn't a member are dropped.
+func (b *HybridBackend) Reply(req Request, text string) MessageHandle {
+	member, ok := b.memberFor(req)
+	if !ok {
+		log.Printf("No %q backend to reply on, dropping reply", req.Backend)
+		return MessageHandle{}
+	}
+	if req.Channel == "" {
+		req.Channel = b.backends[member].Channel
+	}
+	return b.send(member, text, req)
+}
+
+// memberFor returns the member that received req
+func (b *HybridBackend) memberFor(req Request) (int, bool) {
+	return b.memberNamed(req.Backend)
+}
+
+// memberNamed returns the member whose BackendName is name
+func (b *HybridBackend) memberNamed(name string) (int, bool) {
+	for i, backend := range b.backends {
+		if named, ok := backend.Backend.(namedBackend); ok && named.BackendName() == name {
+			return i, true
+		}
 	}
+	return 0, false
 }
 
-func (b *HybridBackend) SendMessage(text string, _ string) {
+// ReplyInThread replies in a thread on req's message on the member that
+// received it, or in its channel if the member doesn't have threads. Thread
+// replies aren't bridged.
+func (b *HybridBackend) ReplyInThread(req Request, text string) (MessageHandle, error) {
+	if member, ok := b.memberFor(req); ok {
+		if r, ok := b.backends[member].Backend.(threadReplier); ok {
+			return r.ReplyInThread(req, text)
+		}
+	}
+	return b.Reply(req, text), nil
+}
+
+// EditMessage edits a message on the member that sent it
+func (b *HybridBackend) EditMessage(handle MessageHandle, text string) error {
+	if member, ok := b.memberNamed(handle.Backend); ok {
+		if e, ok := b.backends[member].Backend.(MessageEditor); ok {
+			return e.EditMessage(handle, text)
+		}
+	}
+	return ErrEditsUnsupported
+}
+
+// messageLimit is the limit of the member that received req. When bridging,
+// the reply is mirrored to every member, so it's the smallest of them.
+func (b *HybridBackend) messageLimit(req Request) int {
+	members := b.backends
+	if !b.Bridging() {
+		member, ok := b.memberFor(req)
+		if !ok {
+			return 0
+		}
+		members = b.backends[member : member+1]
+	}
+	limit := 0
+	for _, backend := range members {
+		if l, ok := backend.Backend.(messageLimiter); ok {
+			if m := l.messageLimit(req); m > 0 && (limit == 0 || m < limit) {
+				limit = m
+			}
+		}
+	}
+	return limit
+}
+
+// messageFormat is the markup of the member that received req
+func (b *HybridBackend) messageFormat(req Request) Format {
+	if member, ok := b.memberFor(req); ok {
+		if f, ok := b.backends[member].Backend.(formatter); ok {
+			return f.messageFormat(req)
+		}
+	}
+	return FormatPlain
+}
+
+// sendBlocks sends blocks on the member that received req. When bridging,
+// replies are sent as text, so they can be mirrored.
+func (b *HybridBackend) sendBlocks(req Request, blocks []map[string]any, text string) error {
+	if member, ok := b.memberFor(req); ok && !b.Bridging() {
+		if s, ok := b.backends[member].Backend.(blockSender); ok {
+			return s.sendBlocks(req, blocks, text)
+		}
+	}
+	return errBlocksUnsupported
+}
+
+// UploadFile uploads a file on the member that received req. Uploads aren't
+// bridged.
+func (b *HybridBackend) UploadFile(req Request, name, title, content string) error {
+	if member, ok := b.memberFor(req); ok {
+		if u, ok := b.backends[member].Backend.(FileUploader); ok {
+			return u.UploadFile(req, name, title, content)
+		}
+	}
+	return ErrUploadsUnsupported
+}
+
+// React reacts to req's message on the member that received it, if it
+// supports reactions
+func (b *HybridBackend) React(req Request, reaction string) error {
+	if member, ok := b.memberFor(req); ok {
+		if r, ok := b.backends[member].Backend.(reactor); ok {
+			return r.React(req, reaction)
+		}
+	}
+	return nil
+}
+
+// Unreact removes a reaction from req's message on the member that received
+// it, if it supports that
+func (b *HybridBackend) Unreact(req Request, reaction string) error {
+	if member, ok := b.memberFor(req); ok {
+		if r, ok := b.backends[member].Backend.(unreactor); ok {
+			return r.Unreact(req, reaction)
+		}
+	}
+	return nil
+}
+
+// AdvertiseCommands advertises commands on the members that support it
+func (b *HybridBackend) AdvertiseCommands(commands []chat1.UserBotCommandInput) error {
+	var errs []error
 	for _, backend := range b.backends {
-		backend.Backend.SendMessage(text, backend.Channel)
+		if advertiser, ok := backend.Backend.(commandAdvertiser); ok {
+			errs = append(errs, advertiser.AdvertiseCommands(commands))
+		}
 	}
+	return errors.Join(errs...)
 }
 
+// Listen listens on every member, restarting members that stop until Stop is
+// called
 func (b *HybridBackend) Listen(runner BotCommandRunner) {
 	var wg sync.WaitGroup
-	for _, backend := range b.backends {
+	for i := range b.backends {
 		wg.Add(1)
-		go func(b HybridBackendMember) {
-			b.Backend.Listen(newHybridRunner(runner, b.Channel))
+		go func(member int) {
+			b.supervise(member, newHybridRunner(runner, b, member))
 			wg.Done()
-		}(backend)
+		}(i)
 	}
 	wg.Wait()
 }
@@ -0,0 +1,365 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// BackendIRC is the backend name of requests from an IRCBackend
+const BackendIRC = "irc"
+
+const (
+	// ircMaxLine is the longest line IRC allows, including the CRLF
+	ircMaxLine = 512
+	// ircPrefixAllowance leaves room for the ":nick!user@host " prefix the
+	// server adds when relaying our messages
+	ircPrefixAllowance = 100
+	// ircBurst is how many lines go out before sending is throttled
+	ircBurst = 5
+)
+
+// IRCConfig says how to connect to IRC
+type IRCConfig struct {
+	// Addr is the server's host:port
+	Addr string
+	// TLS connects with TLS
+	TLS bool
+	// Nick is the bot's nickname; commands start with "!nick"
+	Nick string
+	// Password is sent with PASS, if set
+	Password string
+	// Channels are joined once connected. The first is where messages go
+	// when no channel is given.
+	Channels []string
+}
+
+// IRCBackend is an IRC bot backend. It reconnects when the connection drops
+// and splits long messages to fit IRC's line limit.
+type IRCBackend struct {
+	config IRCConfig
+	// lineDelay throttles lines after the first few, to stay under servers'
+	// flood limits
+	lineDelay time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	nick string
+	done chan struct{}
+}
+
+// NewIRCBackend returns an IRC backend for config
+func NewIRCBackend(config IRCConfig) *IRCBackend {
+	return &IRCBackend{
+		config:    config,
+		lineDelay: 500 * time.Millisecond,
+		nick:      config.Nick,
+		done:      make(chan struct{}),
+	}
+}
+
+// Close disconnects and stops Listen
+func (b *IRCBackend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+	close(b.done)
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+func (b *IRCBackend) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Listen connects and handles messages until Close, reconnecting with backoff
+// when the connection drops
+func (b *IRCBackend) Listen(runner BotCommandRunner) {
+	backoff := time.Second
+	for !b.closed() {
+		started := time.Now()
+		err := b.listenOnce(runner)
+		if b.closed() {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("IRC connection to %s closed (%v), reconnecting in %s", b.config.Addr, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-b.done:
+			return
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+func (b *IRCBackend) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if b.config.TLS {
+		return tls.DialWithDialer(dialer, "tcp", b.config.Addr, &tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	return dialer.Dial("tcp", b.config.Addr)
+}
+
+func (b *IRCBackend) listenOnce(runner BotCommandRunner) error {
+	conn, err := b.dial()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if b.closed() {
+		b.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	b.conn = conn
+	b.nick = b.config.Nick
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	if b.config.Password != "" {
+		if err := b.send("PASS " + b.config.Password); err != nil {
+			return err
+		}
+	}
+	if err := b.send("NICK " + b.config.Nick); err != nil {
+		return err
+	}
+	if err := b.send(fmt.Sprintf("USER %s 0 * :%s", b.config.Nick, b.config.Nick)); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if err := b.handleLine(scanner.Text(), runner); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("server closed the connection")
+}
+
+// ircMessage is a parsed IRC protocol line
+type ircMessage struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func parseIRCLine(line string) ircMessage {
+	var msg ircMessage
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		msg.prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	var trailing string
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i >= 0 {
+		trailing, hasTrailing = line[i+2:], true
+		line = line[:i]
+	} else if strings.HasPrefix(line, ":") {
+		trailing, hasTrailing = line[1:], true
+		line = ""
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		msg.command, msg.params = strings.ToUpper(fields[0]), fields[1:]
+	}
+	if hasTrailing {
+		msg.params = append(msg.params, trailing)
+	}
+	return msg
+}
+
+func (b *IRCBackend) handleLine(line string, runner BotCommandRunner) error {
+	msg := parseIRCLine(line)
+	switch msg.command {
+	case "PING":
+		return b.send("PONG :" + strings.Join(msg.params, " "))
+	case "001": // welcome, to the nick the server accepted
+		if len(msg.params) > 0 {
+			b.setNick(msg.params[0])
+		}
+		for _, channel := range b.config.Channels {
+			if err := b.send("JOIN " + channel); err != nil {
+				return err
+			}
+		}
+	case "433": // nick in use
+		b.mu.Lock()
+		b.nick += "_"
+		nick := b.nick
+		b.mu.Unlock()
+		return b.send("NICK " + nick)
+	case "NICK":
+		// The server, or an operator, can change the bot's nick
+		nick, _, _ := strings.Cut(msg.prefix, "!")
+		if len(msg.params) > 0 && strings.EqualFold(nick, b.currentNick()) {
+			b.setNick(msg.params[0])
+		}
+	case "PRIVMSG":
+		if len(msg.params) < 2 {
+			return nil
+		}
+		nick, _, _ := strings.Cut(msg.prefix, "!")
+		target, text := msg.params[0], msg.params[1]
+		if isIRCChannel(target) {
+			observeMessage(runner, ChatMessage{
+				Backend:  BackendIRC,
+				Channel:  target,
+				UserID:   msg.prefix,
+				Username: nick,
+				Text:     text,
+			})
+		}
+		args := parseInput(text)
+		if len(args) == 0 || !strings.EqualFold(args[0], "!"+b.currentNick()) {
+			return nil
+		}
+		// Direct messages are answered directly
+		channel := target
+		if !isIRCChannel(target) {
+			channel = nick
+		}
+		req := Request{
+			Args:     args[1:],
+			Backend:  BackendIRC,
+			Channel:  channel,
+			UserID:   msg.prefix,
+			Username: nick,
+			Text:     text,
+		}
+		if err := runner.RunCommand(req); err != nil {
+			log.Printf("failed to run command: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// currentNick is the bot's nick on the server, which is Nick unless it was
+// taken
+func (b *IRCBackend) currentNick() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nick
+}
+
+func (b *IRCBackend) setNick(nick string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nick = nick
+}
+
+// isIRCChannel checks whether a PRIVMSG target is a channel rather than a nick
+func isIRCChannel(target string) bool {
+	return strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&")
+}
+
+// send writes a line to the current connection
+func (b *IRCBackend) send(line string) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("Not connected")
+	}
+	if strings.ContainsAny(line, "\r\n\x00") {
+		return fmt.Errorf("Refusing to send a line with a line break or NUL: %q", line)
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *IRCBackend) BackendName() string {
+	return BackendIRC
+}
+
+// SendMessage sends text to a channel or nick, a line at a time. IRC messages
+// can't be edited, so the handle is empty.
+func (b *IRCBackend) SendMessage(text string, channel string) MessageHandle {
+	if channel == "" && len(b.config.Channels) > 0 {
+		channel = b.config.Channels[0]
+	}
+	if channel == "" {
+		log.Printf("No channel to send message: %s", text)
+		return MessageHandle{}
+	}
+	command := "PRIVMSG " + channel + " :"
+	lines := splitIRCMessage(text, ircMaxLine-2-ircPrefixAllowance-len(command))
+	for i, line := range lines {
+		if i >= ircBurst && b.lineDelay > 0 {
+			time.Sleep(b.lineDelay)
+		}
+		if err := b.send(command + line); err != nil {
+			log.Printf("Unable to send message: %s", err)
+			break
+		}
+	}
+	return MessageHandle{}
+}
+
+// ircControlReplacer replaces the characters that would end an IRC line
+// early, so text can't inject protocol lines. A carriage return mid-line, as
+// in progress output, becomes a space.
+var ircControlReplacer = strings.NewReplacer("\r", " ", "\x00", "")
+
+// splitIRCMessage splits text into non-empty lines of at most max bytes,
+// breaking long lines at spaces where possible and never inside a UTF-8
+// sequence
+func splitIRCMessage(text string, max int) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = ircControlReplacer.Replace(strings.TrimRight(line, "\r"))
+		for len(line) > max {
+			cut := max
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				// Not UTF-8, so any cut will do
+				cut = max
+			}
+			if space := strings.LastIndexByte(line[:cut], ' '); space > 0 {
+				cut = space
+			}
+			lines = append(lines, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
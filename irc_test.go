@@ -0,0 +1,120 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// ircClient is the server's view of a connected bot
+type ircClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c ircClient) send(line string) {
+	_, err := fmt.Fprintf(c.conn, "%s\r\n", line)
+	require.NoError(c.t, err)
+}
+
+func (c ircClient) expect(prefix string) string {
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		line, err := c.reader.ReadString('\n')
+		require.NoError(c.t, err)
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func acceptIRC(t *testing.T, listener net.Listener) ircClient {
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return ircClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func TestIRCBackend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	backend := NewIRCBackend(IRCConfig{Addr: listener.Addr().String(), Nick: "testbot", Password: "pw", Channels: []string{"#builds"}})
+	backend.lineDelay = 0
+	defer backend.Close()
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.AddCommand("echo", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		return strings.Join(req.Args[1:], " ") + " from " + req.Sender() + "\n\nsecond line", nil
+	}, "Echo", bot.Config()))
+	go bot.Listen()
+
+	client := acceptIRC(t, listener)
+	client.expect("PASS pw")
+	client.expect("NICK testbot")
+	client.expect("USER testbot")
+	client.send(":server 433 * testbot :Nickname is already in use")
+	client.expect("NICK testbot_")
+	client.send(":server 001 testbot_ :Welcome")
+	client.expect("JOIN #builds")
+	client.send("PING :abc")
+	client.expect("PONG :abc")
+
+	// Commands are for the nick the server accepted
+	client.send(":alice!a@example.com PRIVMSG #builds :!testbot echo not me")
+	client.send(":alice!a@example.com PRIVMSG #builds :!testbot_ echo hi")
+	require.Equal(t, "PRIVMSG #builds :hi from alice", client.expect("PRIVMSG"))
+	require.Equal(t, "PRIVMSG #builds :second line", client.expect("PRIVMSG"))
+	client.send(":testbot_!t@example.com NICK :testbot")
+	client.send(":bob!b@example.com PRIVMSG testbot :!testbot echo psst")
+	require.Equal(t, "PRIVMSG bob :psst from bob", client.expect("PRIVMSG"))
+
+	// Dropped connections are redialed
+	client.conn.Close()
+	client = acceptIRC(t, listener)
+	client.expect("NICK testbot")
+	backend.SendMessage("back", "")
+	require.Equal(t, "PRIVMSG #builds :back", client.expect("PRIVMSG"))
+}
+
+func TestParseIRCLine(t *testing.T) {
+	msg := parseIRCLine(":alice!a@host PRIVMSG #builds :!keybot build darwin\r\n")
+	require.Equal(t, ircMessage{prefix: "alice!a@host", command: "PRIVMSG", params: []string{"#builds", "!keybot build darwin"}}, msg)
+	require.Equal(t, ircMessage{command: "PING", params: []string{"server"}}, parseIRCLine("PING :server"))
+	require.Equal(t, ircMessage{command: "JOIN", params: []string{"#a"}}, parseIRCLine("join #a"))
+}
+
+func TestSplitIRCMessage(t *testing.T) {
+	require.Equal(t, []string{"one", "two"}, splitIRCMessage("one\n\n  \ntwo\r\n", 10))
+	require.Equal(t, []string{"hello", "world", "abcdefghij", "klm"}, splitIRCMessage("hello world abcdefghijklm", 10))
+	// Carriage returns and NULs can't start a new protocol line
+	require.Equal(t, []string{"done PRIVMSG #ops :pwned", "x"},
+		splitIRCMessage("done\rPRIVMSG #ops :pwned\x00\nx", 100))
+	// Multi-byte runes aren't cut in half
+	for _, line := range splitIRCMessage(strings.Repeat("é", 10), 5) {
+		require.LessOrEqual(t, len(line), 5)
+		require.True(t, strings.Trim(line, "é") == "", "line %q", line)
+	}
+	// Bytes that aren't UTF-8, as in build output, are cut anywhere
+	require.Equal(t, []string{"\x80\x80\x80\x80\x80", "\x80\x80\x80\x80\x80", "\x80\x80"},
+		splitIRCMessage(strings.Repeat("\x80", 12), 5))
+}
+
+func TestIRCAuth(t *testing.T) {
+	req := Request{Backend: BackendIRC, UserID: "alice!a@example.com", Username: "alice"}
+	require.False(t, req.isUser("alice"))
+	require.False(t, req.isUser("irc:alice"))
+	require.True(t, req.isUser("irc:alice!a@example.com"))
+	require.True(t, req.isUser("alice!a@example.com"))
+}
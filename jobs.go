@@ -0,0 +1,249 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job is a command the bot has started
+type Job struct {
+	ID      string
+	Request Request
+	Started time.Time
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+
+	mu        sync.Mutex
+	cancel    func() error
+	timedOut  bool
+	queuedFor string
+	phase     string
+	logPath   string
+
+	// statusMu guards the job's status message, see Bot.Status
+	statusMu      sync.Mutex
+	statusMessage MessageHandle
+	statusDone    bool
+}
+
+// Context is cancelled when the job is cancelled or times out
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// SetCancel sets extra cleanup to run when the job is cancelled, for commands
+// that start something the context doesn't reach (a launchd job)
+func (j *Job) SetCancel(cancel func() error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancel = cancel
+}
+
+// SetLog sets the file a job writes its output to, so it can be followed
+// with !bot follow
+func (j *Job) SetLog(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.logPath = path
+}
+
+// Log is the file the job writes its output to, if it has one
+func (j *Job) Log() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.logPath
+}
+
+// TimedOut is whether the job was cancelled for running too long
+func (j *Job) TimedOut() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.timedOut
+}
+
+// QueuedFor is the lock the job is waiting for, if any
+func (j *Job) QueuedFor() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.queuedFor
+}
+
+// Phase is what the job last said it was doing, with Bot.Status
+func (j *Job) Phase() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.phase
+}
+
+func (j *Job) setPhase(phase string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.phase = phase
+}
+
+func (j *Job) setQueued(lock string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.queuedFor = lock
+}
+
+func (j *Job) stop(timedOut bool) error {
+	j.mu.Lock()
+	cancel := j.cancel
+	j.timedOut = j.timedOut || timedOut
+	j.mu.Unlock()
+	j.cancelCtx()
+	if cancel != nil {
+		return cancel()
+	}
+	return nil
+}
+
+// JobRegistry keeps track of running jobs
+type JobRegistry struct {
+	sync.Mutex
+	nextID int
+	jobs   map[string]*Job
+	// path is where jobs are saved, see RestoreJobs
+	path string
+	// interrupted are the jobs a restart interrupted, by ID
+	interrupted map[string]jobRecord
+}
+
+// NewJobRegistry creates an empty job registry
+func NewJobRegistry() *JobRegistry {
+	return &JobRegistry{
+		nextID:      1,
+		jobs:        make(map[string]*Job),
+		interrupted: make(map[string]jobRecord),
+	}
+}
+
+// Start registers a new job for req
+func (r *JobRegistry) Start(req Request) *Job {
+	r.Lock()
+	defer r.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        strconv.Itoa(r.nextID),
+		Request:   req,
+		Started:   time.Now(),
+		ctx:       ctx,
+		cancelCtx: cancel,
+	}
+	r.nextID++
+	job.Request.JobID = job.ID
+	r.jobs[job.ID] = job
+	r.saveLocked()
+	log.Printf("Started job %s: %q for %s", job.ID, req.Args, req.Sender())
+	return job
+}
+
+// Finish removes a job from the registry
+func (r *JobRegistry) Finish(job *Job) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.jobs, job.ID)
+	r.saveLocked()
+	job.cancelCtx()
+	log.Printf("Finished job %s after %s", job.ID, time.Since(job.Started))
+}
+
+// Get returns a running job by ID
+func (r *JobRegistry) Get(id string) (*Job, bool) {
+	r.Lock()
+	defer r.Unlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+// List returns running jobs, oldest first
+func (r *JobRegistry) List() []*Job {
+	r.Lock()
+	defer r.Unlock()
+	jobs := make([]*Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a < b
+	})
+	return jobs
+}
+
+// Cancel cancels a running job
+func (r *JobRegistry) Cancel(id string) error {
+	job, ok := r.Get(id)
+	if !ok {
+		return fmt.Errorf("No job with ID %s", id)
+	}
+	log.Printf("Cancelling job %s", id)
+	return job.stop(false)
+}
+
+// Jobs returns the registry of running jobs
+func (b *Bot) Jobs() *JobRegistry {
+	return b.jobs
+}
+
+func (b *Bot) listJobs(context.Context, Request) (string, error) {
+	jobs := b.jobs.List()
+	if len(jobs) == 0 {
+		return "Nothing is running.", nil
+	}
+	rows := [][]string{{"ID", "User", "Command", "Status", "Started"}}
+	for _, job := range jobs {
+		status := "running"
+		if lock := job.QueuedFor(); lock != "" {
+			status = "queued for " + lock
+		} else if phase := job.Phase(); phase != "" {
+			status = phase
+		}
+		rows = append(rows, []string{job.ID, job.Request.Sender(), commandLine(job.Request.Args), status,
+			time.Since(job.Started).Round(time.Second).String() + " ago"})
+	}
+	table, err := formatTable(rows)
+	if err != nil {
+		return "", err
+	}
+	return BlockQuote(table), nil
+}
+
+func (b *Bot) cancelJob(_ context.Context, req Request) (string, error) {
+	if len(req.Args) != 2 {
+		return fmt.Sprintf("Usage: `!%s cancel <job id>`", b.name), nil
+	}
+	job, ok := b.jobs.Get(req.Args[1])
+	if !ok {
+		return fmt.Sprintf("No job with ID %s, see `!%s jobs`", req.Args[1], b.name), nil
+	}
+	if err := b.jobs.Cancel(job.ID); err != nil {
+		return err.Error(), nil
+	}
+	return fmt.Sprintf("Cancelled job %s (`%s`).", job.ID, commandLine(job.Request.Args)), nil
+}
+
+// isJobCancel checks whether args are a cancel the job registry should handle.
+// Extensions may have their own cancel command (by launchd label, say), so
+// cancel only goes to the registry when it names a known job or nothing else
+// would handle it.
+func (b *Bot) isJobCancel(args []string) bool {
+	if len(args) == 2 {
+		if _, ok := b.jobs.Get(args[1]); ok {
+			return true
+		}
+	}
+	_, registered := b.commands["cancel"]
+	return !registered && b.defaultCommand == nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// jobRecord is what's saved about a job so it can be offered again if the bot
+// restarts before it finishes
+type jobRecord struct {
+	ID        string
+	Request   Request
+	Started   time.Time
+	QueuedFor string `json:",omitempty"`
+}
+
+// jobsFile is what's saved: the jobs that are running, and the ones an
+// earlier restart interrupted, until they're run again or dismissed
+type jobsFile struct {
+	Running     []jobRecord `json:"running"`
+	Interrupted []jobRecord `json:"interrupted,omitempty"`
+}
+
+// JobsPath is where the bot saves its jobs, next to its config
+func JobsPath() (string, error) {
+	path, err := getConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return path + "-jobs.json", nil
+}
+
+func readJobsFile(path string) (jobsFile, error) {
+	var file jobsFile
+	fileBytes, err := os.ReadFile(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return file, err
+	}
+	// Files from before interrupted jobs were kept are a list of running jobs
+	if trimmed := bytes.TrimSpace(fileBytes); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &file.Running)
+		return file, err
+	}
+	err = json.Unmarshal(fileBytes, &file)
+	return file, err
+}
+
+func writeJobsFile(path string, file jobsFile) error {
+	b, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	// Write and rename so a crash mid-write doesn't lose the previous file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(filepath.Clean(tmp), b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Save writes the running jobs to the registry's file, if it has one
+func (r *JobRegistry) Save() {
+	r.Lock()
+	defer r.Unlock()
+	r.saveLocked()
+}
+
+func (r *JobRegistry) saveLocked() {
+	if r.path == "" {
+		return
+	}
+	file := jobsFile{Running: make([]jobRecord, 0, len(r.jobs))}
+	for _, job := range r.jobs {
+		file.Running = append(file.Running, jobRecord{
+			ID:        job.ID,
+			Request:   job.Request,
+			Started:   job.Started,
+			QueuedFor: job.QueuedFor(),
+		})
+	}
+	for _, record := range r.interrupted {
+		file.Interrupted = append(file.Interrupted, record)
+	}
+	sortJobRecords(file.Interrupted)
+	if err := writeJobsFile(r.path, file); err != nil {
+		log.Printf("Error saving jobs to %s: %s", r.path, err)
+	}
+}
+
+// sortJobRecords sorts records oldest first
+func sortJobRecords(records []jobRecord) {
+	sort.Slice(records, func(i, j int) bool { return records[i].Started.Before(records[j].Started) })
+}
+
+// restore reads the jobs that were running when the bot last stopped, and
+// those still interrupted from before that, and saves jobs to path from the
+// next change on, which is normally setInterrupted. Job IDs carry on from the
+// saved ones so they can't be confused with new jobs.
+func (r *JobRegistry) restore(path string) ([]jobRecord, error) {
+	file, err := readJobsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records := append(file.Interrupted, file.Running...)
+	sortJobRecords(records)
+	r.Lock()
+	defer r.Unlock()
+	for _, record := range records {
+		if id, err := strconv.Atoi(record.ID); err == nil && id >= r.nextID {
+			r.nextID = id + 1
+		}
+	}
+	r.path = path
+	return records, nil
+}
+
+// setInterrupted keeps records as the interrupted jobs, saving them until
+// they're run again or dismissed
+func (r *JobRegistry) setInterrupted(records []jobRecord) {
+	r.Lock()
+	defer r.Unlock()
+	r.interrupted = make(map[string]jobRecord, len(records))
+	for _, record := range records {
+		r.interrupted[record.ID] = record
+	}
+	r.saveLocked()
+}
+
+// interruptedJob looks up a job interrupted by a restart
+func (r *JobRegistry) interruptedJob(id string) (jobRecord, bool) {
+	r.Lock()
+	defer r.Unlock()
+	record, ok := r.interrupted[id]
+	return record, ok
+}
+
+// forgetInterrupted stops keeping an interrupted job, returning false if
+// there wasn't one with id
+func (r *JobRegistry) forgetInterrupted(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.interrupted[id]; !ok {
+		return false
+	}
+	delete(r.interrupted, id)
+	r.saveLocked()
+	return true
+}
+
+// RestoreJobs announces the jobs that were interrupted when the bot last
+// stopped, or earlier and not dealt with yet, offering to run them again. It
+// saves jobs to path from now on so a restart doesn't lose track of them.
+// Call it after SetOptions, since Transient commands aren't offered again.
+func (b *Bot) RestoreJobs(path string) error {
+	records, err := b.jobs.restore(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read jobs from %s: %s", path, err)
+	}
+	var interrupted []jobRecord
+	for _, record := range records {
+		if !b.optionsFor(record.Request.Args).Transient {
+			interrupted = append(interrupted, record)
+		}
+	}
+	b.jobs.setInterrupted(interrupted)
+	for _, record := range interrupted {
+		state := "running"
+		if record.QueuedFor != "" {
+			state = "queued for `" + record.QueuedFor + "`"
+		}
+		log.Printf("Job %s (%q) was interrupted", record.ID, record.Request.Args)
+		b.Reply(record.Request, fmt.Sprintf("I restarted while job %s (`%s`) for %s was %s. To run it again, send `!%s rerun %s`, or `!%s dismiss %s` to forget it.",
+			record.ID, commandLine(record.Request.Args), record.Request.Sender(), state, b.name, record.ID, b.name, record.ID))
+	}
+	return nil
+}
+
+func (b *Bot) rerun(_ context.Context, req Request) (string, error) {
+	if len(req.Args) != 2 {
+		return fmt.Sprintf("Usage: `!%s rerun <job id>`", b.name), nil
+	}
+	record, ok := b.jobs.interruptedJob(req.Args[1])
+	if !ok {
+		return fmt.Sprintf("No interrupted job with ID %s", req.Args[1]), nil
+	}
+
+	// The command runs again as if whoever asked for the rerun had sent it, so
+	// it goes through their permissions, the pause check and confirmation.
+	rerun := req
+	rerun.Args = record.Request.Args
+	rerun.Text = record.Request.Text
+	rerun.Started, rerun.Done = nil, nil
+	if path, ok := b.Config().Auth().Allowed(rerun); !ok {
+		return deniedMessage(rerun, path), nil
+	}
+	if !b.jobs.forgetInterrupted(record.ID) {
+		return fmt.Sprintf("No interrupted job with ID %s", record.ID), nil
+	}
+	log.Printf("Re-running job %s (%q) for %s", record.ID, record.Request.Args, req.Sender())
+	if err := b.RunCommand(rerun); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Running `%s` again.", commandLine(rerun.Args)), nil
+}
+
+func (b *Bot) dismiss(_ context.Context, req Request) (string, error) {
+	if len(req.Args) != 2 {
+		return fmt.Sprintf("Usage: `!%s dismiss <job id>`", b.name), nil
+	}
+	if !b.jobs.forgetInterrupted(req.Args[1]) {
+		return fmt.Sprintf("No interrupted job with ID %s", req.Args[1]), nil
+	}
+	log.Printf("Dismissed interrupted job %s for %s", req.Args[1], req.Sender())
+	return fmt.Sprintf("Forgot interrupted job %s.", req.Args[1]), nil
+}
@@ -3,79 +3,366 @@ package slackbot
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
+// maxKeybaseReadErrors is how many errors in a row Listen reads before giving
+// up on the chat process
+const maxKeybaseReadErrors = 10
+
 type KeybaseChatBotBackend struct {
-	name   string
-	convID chat1.ConvIDStr
-	kbc    *kbchat.API
+	name string
+	// convIDs are the conversations the bot is in; the first is where
+	// messages go when no conversation is given
+	convIDs []chat1.ConvIDStr
+	// convNames maps the team#channel names the conversations were given by
+	// to their IDs
+	convNames map[string]chat1.ConvIDStr
+	opts      kbchat.RunOptions
+
+	mu  sync.Mutex
+	kbc *kbchat.API
+
+	// reactions are the ones the bot has added, since reacting again is
+	// how a Keybase reaction is taken back
+	reactionsMu    sync.Mutex
+	reactions      map[keybaseReaction]bool
+	reactionsOrder []keybaseReaction
+}
+
+// maxKeybaseReactions is how many of the bot's reactions are remembered, so
+// they can be taken back
+const maxKeybaseReactions = 1000
+
+// keybaseReaction is a reaction to a message
+type keybaseReaction struct {
+	convID   chat1.ConvIDStr
+	msgID    chat1.MessageID
+	reaction string
 }
 
 func NewKeybaseChatBotBackend(name string, convID string, opts kbchat.RunOptions) (BotBackend, error) {
-	var err error
-	bot := &KeybaseChatBotBackend{
-		convID: chat1.ConvIDStr(convID),
-		name:   name,
+	var convs []string
+	if convID != "" {
+		convs = append(convs, convID)
+	}
+	return NewKeybaseChatBotBackendForConvs(name, convs, opts)
+}
+
+// NewKeybaseChatBotBackendForConvs returns a backend for the conversations in
+// convs, given by conv ID or as team#channel
+func NewKeybaseChatBotBackendForConvs(name string, convs []string, opts kbchat.RunOptions) (*KeybaseChatBotBackend, error) {
+	kbc, err := kbchat.Start(opts)
+	if err != nil {
+		return nil, err
 	}
-	if bot.kbc, err = kbchat.Start(opts); err != nil {
+	var summaries []chat1.ConvSummary
+	if slices.ContainsFunc(convs, func(conv string) bool { return strings.Contains(conv, "#") }) {
+		if summaries, err = kbc.GetConversations(false); err != nil {
+			return nil, fmt.Errorf("Couldn't list conversations: %s", err)
+		}
+	}
+	convIDs, convNames, err := resolveKeybaseConvs(convs, summaries)
+	if err != nil {
 		return nil, err
 	}
-	return bot, nil
+	return &KeybaseChatBotBackend{
+		name:      name,
+		convIDs:   convIDs,
+		convNames: convNames,
+		opts:      opts,
+		kbc:       kbc,
+	}, nil
 }
 
-func (b *KeybaseChatBotBackend) SendMessage(text string, convID string) {
-	if chat1.ConvIDStr(convID) != b.convID {
-		// bail out if not on configured conv ID
-		log.Printf("SendMessage: refusing to send on non-configured convID: %s != %s\n", convID, b.convID)
-		return
+// resolveKeybaseConvs looks up the IDs of conversations given as team#channel
+// in summaries, returning the IDs of all of convs and the names that were
+// resolved
+func resolveKeybaseConvs(convs []string, summaries []chat1.ConvSummary) ([]chat1.ConvIDStr, map[string]chat1.ConvIDStr, error) {
+	var convIDs []chat1.ConvIDStr
+	convNames := make(map[string]chat1.ConvIDStr)
+	for _, conv := range convs {
+		team, channel, named := strings.Cut(conv, "#")
+		if !named {
+			convIDs = append(convIDs, chat1.ConvIDStr(conv))
+			continue
+		}
+		i := slices.IndexFunc(summaries, func(s chat1.ConvSummary) bool {
+			return s.Channel.MembersType == "team" && strings.EqualFold(s.Channel.Name, team) &&
+				strings.EqualFold(s.Channel.TopicName, channel)
+		})
+		if i < 0 {
+			return nil, nil, fmt.Errorf("No conversation %s, is the bot in the team and channel?", conv)
+		}
+		convIDs = append(convIDs, summaries[i].Id)
+		convNames[conv] = summaries[i].Id
+	}
+	return convIDs, convNames, nil
+}
+
+// api returns the current kbchat API
+func (b *KeybaseChatBotBackend) api() *kbchat.API {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.kbc
+}
+
+// Restart starts a new keybase chat process, for listening again after
+// Listen returns
+func (b *KeybaseChatBotBackend) Restart() error {
+	kbc, err := kbchat.Start(b.opts)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	old := b.kbc
+	b.kbc = kbc
+	b.mu.Unlock()
+	if err := old.Shutdown(); err != nil {
+		log.Printf("Error shutting down old keybase chat process: %s", err)
+	}
+	return nil
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *KeybaseChatBotBackend) BackendName() string {
+	return BackendKeybase
+}
+
+// channelID returns the conversation ID of a team#channel name
+func (b *KeybaseChatBotBackend) channelID(name string) string {
+	return string(b.convNames[name])
+}
+
+// keybaseMessageID parses a Keybase message ID
+func keybaseMessageID(id string) (chat1.MessageID, error) {
+	msgID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid message ID %q: %s", id, err)
+	}
+	return chat1.MessageID(msgID), nil
+}
+
+// ReplyInThread replies to the message a request came from. Keybase doesn't
+// have threads, so the reply quotes the message.
+func (b *KeybaseChatBotBackend) ReplyInThread(req Request, text string) (MessageHandle, error) {
+	msgID, err := keybaseMessageID(req.MessageID)
+	if err != nil {
+		return MessageHandle{}, err
+	}
+	resp, err := b.api().SendReplyByConvID(chat1.ConvIDStr(req.Channel), &msgID, "%s", text)
+	if err != nil {
+		return MessageHandle{}, err
+	}
+	return keybaseHandle(chat1.ConvIDStr(req.Channel), resp), nil
+}
+
+// keybaseHandle returns the handle of a message the bot sent
+func keybaseHandle(convID chat1.ConvIDStr, resp kbchat.SendResponse) MessageHandle {
+	if resp.Result.MessageID == nil {
+		return MessageHandle{}
+	}
+	return MessageHandle{
+		Backend: BackendKeybase,
+		Channel: string(convID),
+		ID:      strconv.FormatUint(uint64(*resp.Result.MessageID), 10),
+	}
+}
+
+// EditMessage replaces the text of a message the bot sent
+func (b *KeybaseChatBotBackend) EditMessage(handle MessageHandle, text string) error {
+	msgID, err := keybaseMessageID(handle.ID)
+	if err != nil {
+		return err
+	}
+	_, err = b.api().EditByConvID(chat1.ConvIDStr(handle.Channel), msgID, text)
+	return err
+}
+
+// messageLimit is the longest message Keybase accepts
+func (b *KeybaseChatBotBackend) messageLimit(Request) int {
+	return keybaseMessageLimit
+}
+
+// messageFormat is Keybase's markdown
+func (b *KeybaseChatBotBackend) messageFormat(Request) Format {
+	return FormatKeybase
+}
+
+// UploadFile sends a file as an attachment to the conversation a request came
+// from. The keybase service reads it from disk, so it's written to a
+// temporary directory first.
+func (b *KeybaseChatBotBackend) UploadFile(req Request, name, title, content string) error {
+	convID := chat1.ConvIDStr(req.Channel)
+	if !b.hasConv(convID) {
+		return fmt.Errorf("Refusing to upload to non-configured conv %q", req.Channel)
+	}
+	dir, err := os.MkdirTemp("", "slackbot-upload")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, filepath.Base(name))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return err
+	}
+	_, err = b.api().SendAttachmentByConvID(convID, path, title)
+	return err
+}
+
+// React adds a reaction to the message a request came from. Keybase
+// reactions are emoji shortcodes, like ":eyes:".
+func (b *KeybaseChatBotBackend) React(req Request, reaction string) error {
+	return b.toggleReaction(req, reaction, true)
+}
+
+// Unreact removes a reaction the bot added. Reacting again with the same
+// emoji takes a Keybase reaction back, so only reactions the bot knows it
+// added are sent again; anything else would add the reaction instead.
+func (b *KeybaseChatBotBackend) Unreact(req Request, reaction string) error {
+	return b.toggleReaction(req, reaction, false)
+}
+
+// toggleReaction reacts to req's message if the bot's reaction isn't there
+// and add is set, or if it is there and add isn't
+func (b *KeybaseChatBotBackend) toggleReaction(req Request, reaction string, add bool) error {
+	msgID, err := keybaseMessageID(req.MessageID)
+	if err != nil {
+		return err
+	}
+	key := keybaseReaction{convID: chat1.ConvIDStr(req.Channel), msgID: msgID, reaction: reaction}
+	b.reactionsMu.Lock()
+	defer b.reactionsMu.Unlock()
+	if b.reactions[key] == add {
+		return nil
+	}
+	if _, err := b.api().ReactByConvID(key.convID, msgID, ":"+reaction+":"); err != nil {
+		return err
+	}
+	if add {
+		if b.reactions == nil {
+			b.reactions = make(map[keybaseReaction]bool)
+		}
+		b.reactions[key] = true
+		b.reactionsOrder = append(b.reactionsOrder, key)
+		if len(b.reactionsOrder) > maxKeybaseReactions {
+			delete(b.reactions, b.reactionsOrder[0])
+			b.reactionsOrder = b.reactionsOrder[1:]
+		}
+	} else {
+		delete(b.reactions, key)
+	}
+	return nil
+}
+
+// hasConv checks whether the bot is configured for a conversation
+func (b *KeybaseChatBotBackend) hasConv(convID chat1.ConvIDStr) bool {
+	return slices.Contains(b.convIDs, convID)
+}
+
+// SendMessage sends text to a conversation, given by ID or team#channel, or to
+// the first conversation if conv is empty
+func (b *KeybaseChatBotBackend) SendMessage(text string, conv string) MessageHandle {
+	convID := chat1.ConvIDStr(conv)
+	if id, ok := b.convNames[conv]; ok {
+		convID = id
+	} else if conv == "" && len(b.convIDs) > 0 {
+		convID = b.convIDs[0]
+	}
+	if !b.hasConv(convID) {
+		// bail out if not on a configured conv ID
+		log.Printf("SendMessage: refusing to send on non-configured conv: %q not in %v\n", conv, b.convIDs)
+		return MessageHandle{}
 	}
 	if len(text) == 0 {
 		log.Printf("SendMessage: skipping blank message")
-		return
+		return MessageHandle{}
 	}
 	log.Printf("sending message: convID: %s text: %s", convID, text)
-	if _, err := b.kbc.SendMessageByConvID(chat1.ConvIDStr(convID), "%s", text); err != nil {
+	resp, err := b.api().SendMessageByConvID(convID, "%s", text)
+	if err != nil {
 		log.Printf("SendMessage: failed to send: %s\n", err)
+		return MessageHandle{}
 	}
+	return keybaseHandle(convID, resp)
 }
 
+// AdvertiseCommands advertises commands in each of the bot's conversations
 func (b *KeybaseChatBotBackend) AdvertiseCommands(commands []chat1.UserBotCommandInput) error {
-	if b.convID == "" {
+	if len(b.convIDs) == 0 {
 		return nil
 	}
-	_, err := b.kbc.AdvertiseCommands(kbchat.Advertisement{
-		Alias: b.name,
-		Advertisements: []chat1.AdvertiseCommandAPIParam{{
+	var ads []chat1.AdvertiseCommandAPIParam
+	for _, convID := range b.convIDs {
+		ads = append(ads, chat1.AdvertiseCommandAPIParam{
 			Typ:      "conv",
 			Commands: commands,
-			ConvID:   b.convID,
-		}},
+			ConvID:   convID,
+		})
+	}
+	_, err := b.api().AdvertiseCommands(kbchat.Advertisement{
+		Alias:          b.name,
+		Advertisements: ads,
 	})
 	return err
 }
 
+// Listen handles messages until the keybase chat process stops responding
 func (b *KeybaseChatBotBackend) Listen(runner BotCommandRunner) {
-	sub, err := b.kbc.ListenForNewTextMessages()
+	kbc := b.api()
+	sub, err := kbc.ListenForNewTextMessages()
 	if err != nil {
-		panic(fmt.Sprintf("failed to set up listen: %s", err))
+		log.Printf("Listen: failed to set up listen: %s", err)
+		return
 	}
+	defer sub.Shutdown()
 	commandPrefix := "!" + b.name
+	readErrors := 0
 	for {
 		msg, err := sub.Read()
 		if err != nil {
 			log.Printf("Listen: failed to read message: %s", err)
+			// A few bad messages are fine, but a stream of errors means the
+			// chat process is gone
+			if readErrors++; readErrors >= maxKeybaseReadErrors {
+				return
+			}
 			continue
 		}
-		if msg.Message.Content.TypeName != "text" {
+		readErrors = 0
+		if msg.Message.Content.TypeName != "text" || msg.Message.Sender.Username == kbc.GetUsername() {
 			continue
 		}
+		if !b.hasConv(msg.Message.ConvID) {
+			continue
+		}
+		observeMessage(runner, ChatMessage{
+			Backend:  BackendKeybase,
+			Channel:  string(msg.Message.ConvID),
+			UserID:   string(msg.Message.Sender.Uid),
+			Username: msg.Message.Sender.Username,
+			Text:     msg.Message.Content.Text.Body,
+		})
 		args := parseInput(msg.Message.Content.Text.Body)
-		if len(args) > 0 && args[0] == commandPrefix && b.convID == msg.Message.ConvID {
-			cmd := args[1:]
-			if err := runner.RunCommand(cmd, string(b.convID)); err != nil {
+		if len(args) > 0 && args[0] == commandPrefix {
+			req := Request{
+				Args:      args[1:],
+				Backend:   BackendKeybase,
+				Channel:   string(msg.Message.ConvID),
+				UserID:    string(msg.Message.Sender.Uid),
+				Username:  msg.Message.Sender.Username,
+				MessageID: strconv.FormatUint(uint64(msg.Message.Id), 10),
+				Text:      msg.Message.Content.Text.Body,
+			}
+			if err := runner.RunCommand(req); err != nil {
 				log.Printf("unable to run command: %s", err)
 			}
 		}
@@ -0,0 +1,35 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveKeybaseConvs(t *testing.T) {
+	summaries := []chat1.ConvSummary{
+		{Id: "c1", Channel: chat1.ChatChannel{Name: "keybase", MembersType: "team", TopicName: "general"}},
+		{Id: "c2", Channel: chat1.ChatChannel{Name: "keybase", MembersType: "team", TopicName: "builds"}},
+		{Id: "c3", Channel: chat1.ChatChannel{Name: "alice,keybot", MembersType: "impteamnative"}},
+	}
+	convIDs, convNames, err := resolveKeybaseConvs([]string{"Keybase#builds", "0000abcd"}, summaries)
+	require.NoError(t, err)
+	require.Equal(t, []chat1.ConvIDStr{"c2", "0000abcd"}, convIDs)
+	require.Equal(t, map[string]chat1.ConvIDStr{"Keybase#builds": "c2"}, convNames)
+
+	_, _, err = resolveKeybaseConvs([]string{"keybase#release"}, summaries)
+	require.Error(t, err)
+
+	backend := &KeybaseChatBotBackend{convIDs: convIDs, convNames: convNames}
+	require.True(t, backend.hasConv("0000abcd"))
+	require.False(t, backend.hasConv("c1"))
+	require.Equal(t, "c2", backend.channelID("Keybase#builds"))
+	// The running reaction is taken back when a job finishes, but only if the
+	// bot added it, since reacting again would add it
+	require.Implements(t, (*unreactor)(nil), backend)
+	require.NoError(t, backend.Unreact(Request{Channel: "c2", MessageID: "5"}, ReactionRunning))
+}
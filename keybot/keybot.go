@@ -5,11 +5,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"github.com/keybase/slackbot"
@@ -20,7 +22,7 @@ import (
 
 type keybot struct{}
 
-func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string, error) {
+func (k *keybot) Run(ctx context.Context, bot *slackbot.Bot, req slackbot.Request) (string, error) {
 	app := kingpin.New("keybot", "Job command parser for keybot")
 	app.Terminate(nil)
 	stringBuffer := new(bytes.Buffer)
@@ -84,7 +86,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 	upgrade := app.Command("upgrade", "Upgrade package")
 	upgradePackageName := upgrade.Arg("name", "Package name (yarn, go, fastlane, etc)").Required().String()
 
-	cmd, usage, cmdErr := cli.Parse(app, args, stringBuffer)
+	cmd, usage, cmdErr := cli.Parse(app, req.Args, stringBuffer)
 	if usage != "" || cmdErr != nil {
 		return usage, cmdErr
 	}
@@ -108,7 +110,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 		if *cancelLabel == "" {
 			return "Label required for cancel", errors.New("Label required for cancel")
 		}
-		return launchd.Stop(*cancelLabel)
+		return launchd.Stop(ctx, *cancelLabel)
 
 	case buildDarwin.FullCommand():
 		smokeTest := true
@@ -137,7 +139,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "ARCH", Value: *buildDarwinArch},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case buildMobile.FullCommand():
 		skipCI := *buildMobileSkipCI
@@ -159,7 +161,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			},
 		}
 		env.GoPath = env.PathFromHome("go-ios")
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case buildAndroid.FullCommand():
 		skipCI := *buildAndroidSkipCI
@@ -178,7 +180,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			},
 		}
 		env.GoPath = env.PathFromHome("go-android") // Custom go path for Android so we don't conflict
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case buildIOS.FullCommand():
 		skipCI := *buildIOSSkipCI
@@ -196,7 +198,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			},
 		}
 		env.GoPath = env.PathFromHome("go-ios") // Custom go path for iOS so we don't conflict
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case releasePromote.FullCommand():
 		script := launchd.Script{
@@ -209,7 +211,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "DRY_RUN", Value: boolToString(*releaseToPromoteDryRun)},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case dumplogCmd.FullCommand():
 		readPath, err := env.LogPathForLaunchdLabel(*dumplogCommandLabel)
@@ -225,7 +227,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "NOLOG", Value: boolToEnvString(true)},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case gitDiffCmd.FullCommand():
 		rawRepoText := *gitDiffRepo
@@ -241,7 +243,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "SCRIPT_TO_RUN", Value: "./git_diff.sh"},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case gitCleanCmd.FullCommand():
 		script := launchd.Script{
@@ -252,7 +254,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "SCRIPT_TO_RUN", Value: "./git_clean.sh"},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case nodeModuleCleanCmd.FullCommand():
 		script := launchd.Script{
@@ -263,7 +265,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "SCRIPT_TO_RUN", Value: "./node_module_clean.sh"},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case releaseBroken.FullCommand():
 		script := launchd.Script{
@@ -275,7 +277,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "BROKEN_RELEASE", Value: *releaseBrokenVersion},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case smoketest.FullCommand():
 		script := launchd.Script{
@@ -289,7 +291,7 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "SMOKETEST_ENABLE", Value: boolToString(*smoketestEnable)},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 
 	case upgrade.FullCommand():
 		script := launchd.Script{
@@ -299,14 +301,14 @@ func (k *keybot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 				{Key: "NAME", Value: *upgradePackageName},
 			},
 		}
-		return runScript(bot, channel, env, script)
+		return runScript(ctx, bot, req, env, script)
 	}
 
 	return cmd, nil
 }
 
 func (k *keybot) Help(bot *slackbot.Bot) string {
-	out, err := k.Run(bot, "", nil)
+	out, err := k.Run(context.Background(), bot, slackbot.Request{})
 	if err != nil {
 		return fmt.Sprintf("Error getting help: %s", err)
 	}
@@ -327,3 +329,35 @@ func (k *keybot) Advertisements(bot *slackbot.Bot) []chat1.UserBotCommandInput {
 		{Name: "upgrade", Description: "Upgrade a package", Usage: prefix + " upgrade <name>"},
 	}
 }
+
+func (k *keybot) Options() map[string]slackbot.CommandOptions {
+	return map[string]slackbot.CommandOptions{
+		"build":           {Timeout: 4 * time.Hour},
+		"build darwin":    {Timeout: 4 * time.Hour, Lock: "darwin-build"},
+		"build mobile":    {Timeout: 4 * time.Hour, Lock: "mobile-build"},
+		"build android":   {Timeout: 4 * time.Hour, Lock: "mobile-build"},
+		"build ios":       {Timeout: 4 * time.Hour, Lock: "mobile-build"},
+		"release promote": {Confirm: true},
+		"release broken":  {Confirm: true},
+		"smoketest":       {ConfirmIf: enablesSmoketest},
+	}
+}
+
+// enablesSmoketest checks whether smoketest args turn smoketesting on, which
+// has to be confirmed. Like kingpin, the last --enable or --no-enable wins,
+// and a value that isn't a bool is confirmed to be safe.
+func enablesSmoketest(args []string) bool {
+	enable := false
+	for _, arg := range args {
+		switch {
+		case arg == "--enable":
+			enable = true
+		case arg == "--no-enable":
+			enable = false
+		case strings.HasPrefix(arg, "--enable="):
+			value, err := strconv.ParseBool(strings.TrimPrefix(arg, "--enable="))
+			enable = err != nil || value
+		}
+	}
+	return enable
+}
@@ -4,10 +4,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -30,7 +33,7 @@ func boolToEnvString(b bool) string {
 	return "0"
 }
 
-func runScript(bot *slackbot.Bot, channel string, env launchd.Env, script launchd.Script) (string, error) {
+func runScript(ctx context.Context, bot *slackbot.Bot, req slackbot.Request, env launchd.Env, script launchd.Script) (string, error) {
 	if bot.Config().DryRun() {
 		return fmt.Sprintf("I would have run a launchd job (%s)\nPath: %#v\nEnvVars: %#v", script.Label, script.Path, script.EnvVars), nil
 	}
@@ -50,11 +53,46 @@ func runScript(bot *slackbot.Bot, channel string, env launchd.Env, script launch
 		return "", err
 	}
 
-	msg := fmt.Sprintf("I'm starting the job `%s`. To cancel run `!%s cancel %s`", script.Label, bot.Name(), script.Label)
-	bot.SendMessage(msg, channel)
-	return launchd.NewStartCommand(path, script.Label).Run("", nil)
+	// Keep the bot job around for as long as the launchd job runs, so it shows
+	// up in jobs and can be cancelled by ID. Its log is set before it's
+	// announced, so it can be followed right away.
+	job, hasJob := bot.Jobs().Get(req.JobID)
+	if hasJob {
+		if logPath, err := env.LogPathForLaunchdLabel(script.Label); err == nil {
+			job.SetLog(logPath)
+		}
+	}
+
+	cancelArg := script.Label
+	if hasJob {
+		cancelArg = job.ID
+	}
+	msg := fmt.Sprintf("running the launchd job `%s`. To cancel run `!%s cancel %s`", script.Label, bot.Name(), cancelArg)
+	if hasJob {
+		msg += fmt.Sprintf(", to watch its log `!%s follow %s`", bot.Name(), job.ID)
+	}
+	bot.Status(req, msg)
+	out, err := launchd.NewStartCommand(path, script.Label).RunContext(ctx)
+	if err != nil {
+		return out, err
+	}
+
+	if !hasJob {
+		return out, nil
+	}
+	job.SetCancel(func() error {
+		// The job's context is already cancelled by now
+		stopCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := launchd.Stop(stopCtx, script.Label)
+		return err
+	})
+	return out, launchd.Wait(ctx, script.Label, launchdPollInterval)
 }
 
+// launchdPollInterval is how often to check whether a launchd job has finished
+const launchdPollInterval = 15 * time.Second
+
 func addBasicCommands(bot *slackbot.Bot) {
 	bot.AddCommand("date", slackbot.NewExecCommand("/bin/date", nil, true, "Show the current date", bot.Config()))
 	bot.AddCommand("pause", slackbot.NewPauseCommand(bot.Config()))
@@ -63,27 +101,66 @@ func addBasicCommands(bot *slackbot.Bot) {
 	bot.AddCommand("toggle-dryrun", slackbot.NewToggleDryRunCommand(bot.Config()))
 	if runtime.GOOS != "windows" {
 		bot.AddCommand("restart", slackbot.NewExecCommand("/bin/launchctl", []string{"stop", bot.Label()}, false, "Restart the bot", bot.Config()))
+		bot.SetOptions("restart", slackbot.CommandOptions{Transient: true})
+	}
+}
+
+// webhookTokens parses "user:token,user:token" into a map of token to user
+func webhookTokens(s string) map[string]string {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		user, token, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || user == "" || token == "" {
+			continue
+		}
+		tokens[token] = user
+	}
+	return tokens
+}
+
+// setupBot adds the basic commands and the extension to bot
+func setupBot(bot *slackbot.Bot, ext extension) {
+	bot.SetDefaultTimeout(time.Hour)
+	addBasicCommands(bot)
+
+	// Extension
+	runFn := func(ctx context.Context, req slackbot.Request) (string, error) {
+		return ext.Run(ctx, bot, req)
+	}
+	bot.SetDefault(slackbot.NewRequestFuncCommand(runFn, "Extension", bot.Config()))
+	bot.SetHelpDocument(append(bot.HelpDocument(), slackbot.CodeBlock(ext.Help(bot))))
+	bot.AddAdvertisements(ext.Advertisements(bot)...)
+	for path, opts := range ext.Options() {
+		bot.SetOptions(path, opts)
+	}
+}
+
+func restoreJobs(bot *slackbot.Bot) {
+	path, err := slackbot.JobsPath()
+	if err != nil {
+		log.Printf("Not saving jobs: %s", err)
+		return
+	}
+	if err := bot.RestoreJobs(path); err != nil {
+		log.Printf("Error restoring jobs: %s", err)
 	}
 }
 
 type extension interface {
-	Run(b *slackbot.Bot, channel string, args []string) (string, error)
+	Run(ctx context.Context, b *slackbot.Bot, req slackbot.Request) (string, error)
 	Help(bot *slackbot.Bot) string
 	Advertisements(bot *slackbot.Bot) []chat1.UserBotCommandInput
+	Options() map[string]slackbot.CommandOptions
 }
 
-func main() {
-	name := os.Getenv("BOT_NAME")
-	var err error
-	var label string
-	var ext extension
-	var backend slackbot.BotBackend
+// newChatBackend connects to Slack, Keybase, IRC and the CI webhook,
+// whichever are configured
+func newChatBackend(name string) *slackbot.HybridBackend {
 	var hybrids []slackbot.HybridBackendMember
-	var channel string
 
 	// Set up Slack
 	slackChannel := os.Getenv("SLACK_CHANNEL")
-	slackBackend, err := slackbot.NewSlackBotBackend(slackbot.GetTokenFromEnv())
+	slackBackend, err := slackbot.NewSlackBackendFromEnv()
 	if err != nil {
 		log.Printf("failed to initialize Slack backend: %s", err)
 	} else {
@@ -94,8 +171,10 @@ func main() {
 	}
 
 	// Set up Keybase
+	// Conversations are conv IDs or team#channel names, the first being
+	// where announcements go
 	var opts kbchat.RunOptions
-	keybaseChannel := os.Getenv("KEYBASE_CHAT_CONVID")
+	keybaseConvs := splitList(os.Getenv("KEYBASE_CHAT_CONVID"))
 	opts.KeybaseLocation = os.Getenv("KEYBASE_LOCATION")
 	opts.HomeDir = os.Getenv("KEYBASE_HOME")
 	opts.DebugTag = name
@@ -107,47 +186,106 @@ func main() {
 			PaperKey: oneshotPaperkey,
 		}
 	}
-	keybaseBackend, err := slackbot.NewKeybaseChatBotBackend(name, keybaseChannel, opts)
+	keybaseBackend, err := slackbot.NewKeybaseChatBotBackendForConvs(name, keybaseConvs, opts)
 	if err != nil {
 		log.Printf("failed to initialize Keybase backend: %s", err)
 	} else {
+		member := slackbot.HybridBackendMember{Backend: keybaseBackend}
+		if len(keybaseConvs) > 0 {
+			member.Channel = keybaseConvs[0]
+		}
+		hybrids = append(hybrids, member)
+	}
+
+	// Set up IRC
+	if addr := os.Getenv("IRC_SERVER"); addr != "" {
+		config := slackbot.IRCConfig{
+			Addr:     addr,
+			TLS:      os.Getenv("IRC_TLS") != "",
+			Nick:     name,
+			Password: os.Getenv("IRC_PASSWORD"),
+		}
+		if nick := os.Getenv("IRC_NICK"); nick != "" {
+			config.Nick = nick
+		}
+		config.Channels = splitList(os.Getenv("IRC_CHANNELS"))
+		member := slackbot.HybridBackendMember{Backend: slackbot.NewIRCBackend(config)}
+		if len(config.Channels) > 0 {
+			member.Channel = config.Channels[0]
+		}
+		hybrids = append(hybrids, member)
+	}
+
+	// Set up webhook, for CI. Replies to its commands are echoed to the first
+	// chat backend so people can follow along.
+	if addr, tokens := os.Getenv("WEBHOOK_ADDR"), webhookTokens(os.Getenv("WEBHOOK_TOKENS")); addr != "" && len(tokens) > 0 {
+		webhook := slackbot.NewWebhookBackend(addr, tokens)
+		if len(hybrids) > 0 {
+			webhook.SetEcho(hybrids[0].Backend, hybrids[0].Channel)
+		}
 		hybrids = append(hybrids, slackbot.HybridBackendMember{
-			Backend: keybaseBackend,
-			Channel: keybaseChannel,
+			Backend: webhook,
 		})
 	}
 
-	// Set up hybrid backend
-	hybridChannel := ""
-	hybridBackend := slackbot.NewHybridBackend(hybrids...)
+	// Set up hybrid backend, optionally mirroring conversation between the
+	// chats
+	backend := slackbot.NewHybridBackend(hybrids...)
+	backend.SetBridge(os.Getenv("HYBRID_BRIDGE") != "")
+	return backend
+
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func main() {
+	name := os.Getenv("BOT_NAME")
+	var label string
+	var ext extension
+	var backend slackbot.BotBackend
+
+	// A REPL stands in for chat when developing
+	var hybridBackend slackbot.BotBackend
+	if repl, ok := slackbot.NewREPLBackendFromEnv(name); ok {
+		hybridBackend = repl
+	} else {
+		hybridBackend = newChatBackend(name)
+	}
 
 	switch name {
 	case "keybot":
 		ext = &keybot{}
 		label = "keybase.keybot"
 		backend = hybridBackend
-		channel = hybridChannel
 	case "winbot":
 		ext = &winbot{}
 		label = "keybase.winbot"
-		channel = hybridChannel
 		backend = hybridBackend
 	default:
 		log.Fatal("Invalid BOT_NAME")
 	}
 
 	bot := slackbot.NewBot(slackbot.ReadConfigOrDefault(), name, label, backend)
-	addBasicCommands(bot)
+	setupBot(bot, ext)
+	bot.SetThreadReplies(os.Getenv("THREAD_REPLIES") != "")
 
-	// Extension
-	runFn := func(channel string, args []string) (string, error) {
-		return ext.Run(bot, channel, args)
+	if path, err := slackbot.AuditLogPath(); err != nil {
+		log.Printf("Not keeping an audit log: %s", err)
+	} else if err := bot.SetAuditLog(path); err != nil {
+		log.Printf("Error opening audit log: %s", err)
 	}
-	bot.SetDefault(slackbot.NewFuncCommand(runFn, "Extension", bot.Config()))
-	bot.SetHelp(bot.HelpMessage() + "\n\n" + ext.Help(bot))
-	bot.AddAdvertisements(ext.Advertisements(bot)...)
 
-	bot.SendMessage("I'm running.", channel)
+	bot.Broadcast("I'm running.")
+	restoreJobs(bot)
 
 	bot.Listen()
 }
@@ -4,10 +4,15 @@
 package main
 
 import (
+	"context"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/keybase/slackbot"
+	"github.com/keybase/slackbot/launchd"
 )
 
 func TestAddBasicCommands(t *testing.T) {
@@ -24,7 +29,7 @@ func TestPromoteRelease(t *testing.T) {
 		t.Fatal(err)
 	}
 	ext := &keybot{}
-	out, err := ext.Run(bot, "", []string{"release", "promote", "darwin", "1.2.3"})
+	out, err := ext.Run(context.Background(), bot, slackbot.Request{Args: []string{"release", "promote", "darwin", "1.2.3"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -32,7 +37,7 @@ func TestPromoteRelease(t *testing.T) {
 		t.Errorf("Unexpected output: %s", out)
 	}
 
-	out, err = ext.Run(bot, "", []string{"release", "promote", "darwin", "1.2.3", "--dry-run"})
+	out, err = ext.Run(context.Background(), bot, slackbot.Request{Args: []string{"release", "promote", "darwin", "1.2.3", "--dry-run"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,7 +52,7 @@ func TestInvalidUsage(t *testing.T) {
 		t.Fatal(err)
 	}
 	ext := &keybot{}
-	out, err := ext.Run(bot, "", []string{"release", "oops"})
+	out, err := ext.Run(context.Background(), bot, slackbot.Request{Args: []string{"release", "oops"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,3 +60,111 @@ func TestInvalidUsage(t *testing.T) {
 		t.Errorf("Unexpected output: %s", out)
 	}
 }
+
+func TestConfirmConversation(t *testing.T) {
+	backend := slackbot.NewTestBackend("keybot")
+	bot := slackbot.NewBot(slackbot.NewConfig(true, false), "keybot", "keybase.keybot", backend)
+	setupBot(bot, &keybot{})
+	go bot.Listen()
+	defer backend.Disconnect()
+
+	backend.Inject("builds", "alice", "!keybot release promote darwin 1.2.3")
+	msg, err := backend.WaitForMessage("To go ahead", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := regexp.MustCompile("confirm ([0-9a-f]+)").FindStringSubmatch(msg.Text)
+	if token == nil {
+		t.Fatalf("No token in %q", msg.Text)
+	}
+
+	backend.Inject("builds", "bob", "!keybot confirm "+token[1])
+	if _, err := backend.WaitForMessage("Only alice can confirm", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	backend.Inject("builds", "alice", "!keybot confirm "+token[1])
+	if _, err := backend.WaitForMessage("I would have run a launchd job (keybase.release.promote)", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSmoketestConfirm(t *testing.T) {
+	cases := map[string]bool{
+		"smoketest --build-a 1 --platform darwin --enable --max-testers 2":    true,
+		"smoketest --build-a 1 --platform darwin --enable=true":               true,
+		"smoketest --build-a 1 --platform darwin --enable=maybe":              true,
+		"smoketest --build-a 1 --platform darwin --no-enable --max-testers 2": false,
+		"smoketest --build-a 1 --platform darwin --enable=false":              false,
+		"smoketest --enable --no-enable":                                      false,
+	}
+	for command, want := range cases {
+		if got := enablesSmoketest(strings.Fields(command)); got != want {
+			t.Errorf("enablesSmoketest(%q) = %v, want %v", command, got, want)
+		}
+	}
+
+	backend := slackbot.NewTestBackend("keybot")
+	bot := slackbot.NewBot(slackbot.NewConfig(true, false), "keybot", "keybase.keybot", backend)
+	setupBot(bot, &keybot{})
+	go bot.Listen()
+	defer backend.Disconnect()
+
+	backend.Inject("builds", "alice", "!keybot smoketest --build-a 1 --platform darwin --no-enable --max-testers 2")
+	if _, err := backend.WaitForMessage("I would have run a launchd job (keybase.smoketest)", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	backend.Inject("builds", "alice", "!keybot smoketest --build-a 1 --platform darwin --enable --max-testers 2")
+	if _, err := backend.WaitForMessage("To go ahead", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookTokens(t *testing.T) {
+	tokens := webhookTokens("ci:abc, deploy:def,broken,:x")
+	if len(tokens) != 2 || tokens["abc"] != "ci" || tokens["def"] != "deploy" {
+		t.Errorf("Unexpected tokens: %v", tokens)
+	}
+}
+
+// followingBackend follows job 1 as soon as a message telling how to is sent
+type followingBackend struct {
+	*slackbot.TestBackend
+	follow func()
+	once   sync.Once
+}
+
+func (b *followingBackend) SendMessage(text string, channel string) slackbot.MessageHandle {
+	handle := b.TestBackend.SendMessage(text, channel)
+	if strings.Contains(text, "to watch its log `!keybot follow 1`") {
+		b.once.Do(b.follow)
+	}
+	return handle
+}
+
+func TestRunScriptFollow(t *testing.T) {
+	backend := &followingBackend{TestBackend: slackbot.NewTestBackend("keybot")}
+	bot := slackbot.NewBot(slackbot.NewConfig(false, false), "keybot", "", backend)
+	// The job keeps running until the follow is answered
+	backend.follow = func() {
+		if err := bot.RunCommand(slackbot.Request{Channel: "builds", Username: "bob", Args: []string{"follow", "1"}}); err != nil {
+			t.Error(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); len(backend.Messages()) < 2 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	env := launchd.NewEnv(t.TempDir(), "")
+	script := launchd.Script{Label: "keybase.test", Path: "test.sh"}
+	bot.AddCommand("test", slackbot.NewRequestFuncCommand(func(ctx context.Context, req slackbot.Request) (string, error) {
+		// Give up before launchctl runs
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		return runScript(ctx, bot, req, env, script)
+	}, "Test", bot.Config()))
+	go bot.Listen()
+
+	backend.Inject("builds", "alice", "!keybot test")
+	if _, err := backend.WaitForMessage("Following job 1 (`test`).", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -25,18 +26,19 @@ import (
 type winbot struct {
 	testAuto chan struct{}
 	stopAuto chan struct{}
+
+	// Keep track of the current build job, protected with a mutex,
+	// to support cancellation
+	buildJobMutex sync.Mutex
+	buildJob      *slackbot.Job
 }
 
 const numLogLines = 10
 
-// Keep track of the current build process, protected with a mutex,
-// to support cancellation
-var (
-	buildProcessMutex sync.Mutex
-	buildProcess      *os.Process
-)
+// winBuildLock keeps windows builds, manual or automated, from overlapping
+const winBuildLock = "windows-build"
 
-func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string, error) {
+func (d *winbot) Run(ctx context.Context, bot *slackbot.Bot, req slackbot.Request) (string, error) {
 	app := kingpin.New("winbot", "Job command parser for winbot")
 	app.Terminate(nil)
 	stringBuffer := new(bytes.Buffer)
@@ -71,7 +73,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 
 	restartCmd := app.Command("restart", "Quit and let calling script invoke bot again")
 
-	cmd, usage, cmdErr := cli.Parse(app, args, stringBuffer)
+	cmd, usage, cmdErr := cli.Parse(app, req.Args, stringBuffer)
 	if usage != "" || cmdErr != nil {
 		return usage, cmdErr
 	}
@@ -87,7 +89,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			d.stopAuto <- struct{}{}
 		}
 		if *startAutoTimerInterval > 0 {
-			go d.winAutoBuild(bot, channel, *startAutoTimerInterval, *startAutoTimerDelay, *startAutoTimerStartHour)
+			go d.winAutoBuild(bot, req, *startAutoTimerInterval, *startAutoTimerDelay, *startAutoTimerStartHour)
 		}
 		return "", nil
 	}
@@ -98,12 +100,12 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 
 	switch cmd {
 	case cancel.FullCommand():
-		buildProcessMutex.Lock()
-		defer buildProcessMutex.Unlock()
-		if buildProcess == nil {
+		d.buildJobMutex.Lock()
+		defer d.buildJobMutex.Unlock()
+		if d.buildJob == nil {
 			return "No build running", nil
 		}
-		if err := buildProcess.Kill(); err != nil {
+		if err := bot.Jobs().Cancel(d.buildJob.ID); err != nil {
 			return "failed to cancel build", err
 		}
 
@@ -143,10 +145,29 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			}
 		}
 
-		msg := fmt.Sprintf(autoBuild+"I'm starting the job `windows build`. To cancel run `!%s cancel`. ", bot.Name())
-		msg = fmt.Sprintf(msg+"updateChannel is %s, smokeTest is %v, devCert is %v, logFileName %s",
-			updateChannel, smokeTest, devCert, logFileName)
-		bot.SendMessage(msg, channel)
+		// The build runs for as long as this command does, so it is tracked by
+		// the job it runs as: the bot's for a request, or runAutoBuild's for an
+		// automated build
+		job, ok := bot.Jobs().Get(req.JobID)
+		if !ok {
+			return "", fmt.Errorf("No job to run the windows build as")
+		}
+		job.SetLog(logFileName)
+		d.buildJobMutex.Lock()
+		d.buildJob = job
+		d.buildJobMutex.Unlock()
+		defer func() {
+			d.buildJobMutex.Lock()
+			d.buildJob = nil
+			d.buildJobMutex.Unlock()
+		}()
+
+		status := func(phase string) {
+			bot.Status(req, fmt.Sprintf(autoBuild+"%s. To cancel run `!%s cancel %s`, to watch its log `!%s follow %s`",
+				phase, bot.Name(), job.ID, bot.Name(), job.ID))
+		}
+		status(fmt.Sprintf("updating the client repo (updateChannel is %s, smokeTest is %v, devCert is %v, logFileName %s)",
+			updateChannel, smokeTest, devCert, logFileName))
 
 		if err := os.Remove(logFileName); err != nil && !os.IsNotExist(err) {
 			log.Printf("Error writing to log: %s", err)
@@ -156,8 +177,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			return "Unable to open logfile", err
 		}
 
-		//nolint:noctx // Long-running git operation, no request context available
-		gitCmd := exec.Command(
+		gitCmd := exec.CommandContext(ctx,
 			"git.exe",
 			"checkout",
 			"master",
@@ -177,8 +197,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			return string(stdoutStderr), err
 		}
 
-		//nolint:noctx // Long-running git operation, no request context available
-		gitCmd = exec.Command(
+		gitCmd = exec.CommandContext(ctx,
 			"git.exe",
 			"pull",
 		)
@@ -198,11 +217,10 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 		}
 
 		if buildWindowsCientCommit != nil && *buildWindowsCientCommit != "" && *buildWindowsCientCommit != "master" {
-			msg := fmt.Sprintf(autoBuild+"I'm trying to use commit %s", *buildWindowsCientCommit)
-			bot.SendMessage(msg, channel)
+			status(fmt.Sprintf("checking out commit %s", *buildWindowsCientCommit))
 
-			//nolint:gosec,noctx // Checking out user-specified commit, no request context available
-			gitCmd = exec.Command(
+			//nolint:gosec // Checking out user-specified commit
+			gitCmd = exec.CommandContext(ctx,
 				"git.exe",
 				"checkout",
 				*buildWindowsCientCommit,
@@ -224,8 +242,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			}
 
 			// Test if we're on a branch. If so, do git pull once more.
-			//nolint:noctx // Long-running git operation, no request context available
-			gitCmd = exec.Command(
+			gitCmd = exec.CommandContext(ctx,
 				"git.exe",
 				"rev-parse",
 				"--abbrev-ref",
@@ -244,8 +261,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			}
 			commit := strings.TrimSpace(string(stdoutStderr))
 			if commit != "HEAD" {
-				//nolint:noctx // Long-running git operation, no request context available
-				gitCmd = exec.Command(
+				gitCmd = exec.CommandContext(ctx,
 					"git.exe",
 					"pull",
 				)
@@ -266,8 +282,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			}
 		}
 
-		//nolint:noctx // Long-running git operation, no request context available
-		gitCmd = exec.Command(
+		gitCmd = exec.CommandContext(ctx,
 			"git.exe",
 			"rev-parse",
 			"HEAD",
@@ -287,8 +302,8 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			log.Printf("Error writing to log: %s", writeErr)
 		}
 
-		//nolint:gosec,noctx // Build script execution from known location in GOPATH, no request context available
-		cmd := exec.Command(
+		//nolint:gosec // Build script execution from known location in GOPATH
+		cmd := exec.CommandContext(ctx,
 			"cmd", "/c",
 			path.Join(os.Getenv("GOPATH"), "src/github.com/keybase/client/packaging/windows/dorelease.cmd"),
 			">>",
@@ -309,88 +324,80 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			log.Printf("Error closing log: %s", closeErr)
 		}
 
-		go func() {
-			err := cmd.Start()
+		status("building")
+		err = cmd.Start()
+		if err != nil {
+			bot.Reply(req, fmt.Sprintf("unable to start: %s", err))
+		}
+		err = cmd.Wait()
+
+		bucketName := os.Getenv("BUCKET_NAME")
+		if bucketName == "" {
+			bucketName = "prerelease.keybase.io"
+		}
+		// Upload the log even if the build was cancelled
+		logCtx, cancelLog := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+		defer cancelLog()
+		//nolint:gosec // Executing release tool from known location in GOPATH with safe arguments
+		sendLogCmd := exec.CommandContext(logCtx,
+			path.Join(os.Getenv("GOPATH"), "src/github.com/keybase/client/go/release/release.exe"),
+			"save-log",
+			"--maxsize=5000000",
+			"--bucket-name="+bucketName,
+			"--path="+logFileName,
+		)
+		resultMsg := autoBuild + "Finished the job `windows build`"
+		if err != nil {
+			resultMsg = autoBuild + "Error in job `windows build`"
+			var lines [numLogLines]string
+			// Send a log snippet too
+			index := 0
+			lineCount := 0
+
+			f, err := os.Open(logFileName)
 			if err != nil {
-				bot.SendMessage(fmt.Sprintf("unable to start: %s", err), channel)
-			}
-			buildProcessMutex.Lock()
-			buildProcess = cmd.Process
-			buildProcessMutex.Unlock()
-			err = cmd.Wait()
-
-			bucketName := os.Getenv("BUCKET_NAME")
-			if bucketName == "" {
-				bucketName = "prerelease.keybase.io"
+				bot.Reply(req, autoBuild+"Error reading "+logFileName+": "+err.Error())
 			}
-			//nolint:gosec,noctx // Executing release tool from known location in GOPATH with safe arguments, no context available
-			sendLogCmd := exec.Command(
-				path.Join(os.Getenv("GOPATH"), "src/github.com/keybase/client/go/release/release.exe"),
-				"save-log",
-				"--maxsize=5000000",
-				"--bucket-name="+bucketName,
-				"--path="+logFileName,
-			)
-			resultMsg := autoBuild + "Finished the job `windows build`"
-			if err != nil {
-				resultMsg = autoBuild + "Error in job `windows build`"
-				var lines [numLogLines]string
-				// Send a log snippet too
-				index := 0
-				lineCount := 0
 
-				f, err := os.Open(logFileName)
-				if err != nil {
-					bot.SendMessage(autoBuild+"Error reading "+logFileName+": "+err.Error(), channel)
-				}
-
-				scanner := bufio.NewScanner(f)
-				for scanner.Scan() {
-					lines[lineCount%numLogLines] = scanner.Text()
-					lineCount++
-				}
-				if err := scanner.Err(); err != nil {
-					bot.SendMessage(autoBuild+"Error scanning "+logFileName+": "+err.Error(), channel)
-				}
-				if lineCount > numLogLines {
-					index = lineCount % numLogLines
-					lineCount = numLogLines
-				}
-				var snippet strings.Builder
-				snippet.WriteString("```\n")
-				for i := 0; i < lineCount; i++ {
-					snippet.WriteString(lines[(i+index)%numLogLines] + "\n")
-				}
-				snippet.WriteString("```")
-				bot.SendMessage(snippet.String(), channel)
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				lines[lineCount%numLogLines] = scanner.Text()
+				lineCount++
 			}
-			urlBytes, err2 := sendLogCmd.Output()
-			if err2 != nil {
-				msg := fmt.Sprintf("%s, log upload error %s", resultMsg, err2.Error())
-				bot.SendMessage(msg, channel)
-			} else {
-				msg := fmt.Sprintf("%s, view log at %s", resultMsg, string(urlBytes))
-				bot.SendMessage(msg, channel)
+			if err := scanner.Err(); err != nil {
+				bot.Reply(req, autoBuild+"Error scanning "+logFileName+": "+err.Error())
 			}
-		}()
-		return "", nil
+			if lineCount > numLogLines {
+				index = lineCount % numLogLines
+				lineCount = numLogLines
+			}
+			var snippet strings.Builder
+			snippet.WriteString("```\n")
+			for i := 0; i < lineCount; i++ {
+				snippet.WriteString(lines[(i+index)%numLogLines] + "\n")
+			}
+			snippet.WriteString("```")
+			bot.Reply(req, snippet.String())
+		}
+		status("uploading the log")
+		urlBytes, err2 := sendLogCmd.Output()
+		if err2 != nil {
+			return fmt.Sprintf("%s, log upload error %s", resultMsg, err2.Error()), err
+		}
+		return fmt.Sprintf("%s, view log at %s", resultMsg, string(urlBytes)), err
 	case dumplogCmd.FullCommand():
 		logContents, err := os.ReadFile(logFileName)
 		if err != nil {
 			return "Error reading " + logFileName, err
 		}
-		index := 0
-		if len(logContents) > 1000 {
-			index = len(logContents) - 1000
-		}
-		bot.SendMessage(string(logContents[index:]), channel)
+		// Long logs are uploaded as a file
+		bot.Reply(req, slackbot.BlockQuote(string(logContents)))
 
 	case gitDiffCmd.FullCommand():
 		rawRepoText := *gitDiffRepo
 		repoParsed := strings.Split(strings.Trim(rawRepoText, "`<>"), "|")[1]
 
-		//nolint:noctx // User-initiated git command, no request context available
-		gitDiffCmd := exec.Command(
+		gitDiffCmd := exec.CommandContext(ctx,
 			"git.exe",
 			"diff",
 		)
@@ -404,14 +411,13 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 		if err != nil {
 			return "Error", err
 		}
-		bot.SendMessage(string(stdoutStderr), channel)
+		bot.Reply(req, slackbot.BlockQuote(string(stdoutStderr)))
 
 	case gitCleanCmd.FullCommand():
 		rawRepoText := *gitCleanRepo
 		repoParsed := strings.Split(strings.Trim(rawRepoText, "`<>"), "|")[1]
 
-		//nolint:noctx // User-initiated git command, no request context available
-		gitCleanCmd := exec.Command(
+		gitCleanCmd := exec.CommandContext(ctx,
 			"git.exe",
 			"clean",
 			"-f",
@@ -427,7 +433,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			return "Error", err
 		}
 
-		bot.SendMessage(string(stdoutStderr), channel)
+		bot.Reply(req, string(stdoutStderr))
 
 	case restartCmd.FullCommand():
 		os.Exit(0) //nolint
@@ -436,7 +442,7 @@ func (d *winbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 }
 
 func (d *winbot) Help(bot *slackbot.Bot) string {
-	out, err := d.Run(bot, "", nil)
+	out, err := d.Run(context.Background(), bot, slackbot.Request{})
 	if err != nil {
 		return fmt.Sprintf("Error getting help: %s", err)
 	}
@@ -456,6 +462,13 @@ func (d *winbot) Advertisements(bot *slackbot.Bot) []chat1.UserBotCommandInput {
 	}
 }
 
+func (d *winbot) Options() map[string]slackbot.CommandOptions {
+	return map[string]slackbot.CommandOptions{
+		"build":   {Timeout: 4 * time.Hour, Lock: winBuildLock},
+		"restart": {Transient: true},
+	}
+}
+
 func Exists(name string) (bool, error) {
 	_, err := os.Stat(name)
 	if os.IsNotExist(err) {
@@ -464,7 +477,7 @@ func Exists(name string) (bool, error) {
 	return err != nil, err
 }
 
-func (d *winbot) winAutoBuild(bot *slackbot.Bot, channel string, interval int, delay int, startHour int) {
+func (d *winbot) winAutoBuild(bot *slackbot.Bot, req slackbot.Request, interval int, delay int, startHour int) {
 	d.testAuto = make(chan struct{})
 	d.stopAuto = make(chan struct{})
 	for {
@@ -481,7 +494,7 @@ func (d *winbot) winAutoBuild(bot *slackbot.Bot, channel string, interval int, d
 		}
 
 		msg := fmt.Sprintf("Next automatic build at %s", next.Format(time.RFC822))
-		bot.SendMessage(msg, channel)
+		bot.Reply(req, msg)
 
 		args := []string{"build", "--automated"}
 
@@ -492,10 +505,44 @@ func (d *winbot) winAutoBuild(bot *slackbot.Bot, channel string, interval int, d
 		case <-d.stopAuto:
 			return
 		}
-		message, err := d.Run(bot, channel, args)
-		if err != nil {
-			msg := fmt.Sprintf("AutoBuild ERROR -- %s: %s", message, err.Error())
-			bot.SendMessage(msg, channel)
-		}
+		autoReq := slackbot.NewRequest(req.Channel, args)
+		autoReq.Backend = req.Backend
+		d.runAutoBuild(bot, req, autoReq)
+	}
+}
+
+// runAutoBuild runs an automated build as a job of its own, since it doesn't
+// go through the bot, and waits for the build lock itself
+func (d *winbot) runAutoBuild(bot *slackbot.Bot, req slackbot.Request, autoReq slackbot.Request) {
+	job := bot.Jobs().Start(autoReq)
+	defer bot.Jobs().Finish(job)
+	unlock, err := bot.LockJob(job, winBuildLock)
+	if err != nil {
+		bot.Reply(req, fmt.Sprintf("AutoBuild ERROR -- %s", err.Error()))
+		return
+	}
+	defer unlock()
+
+	// Automated builds get the same timeout as the ones run through the bot
+	timeout := d.Options()["build"].Timeout
+	ctx, cancel := context.WithTimeout(job.Context(), timeout)
+	defer cancel()
+	message, err := d.Run(ctx, bot, job.Request)
+	status := slackbot.AuditOK
+	switch {
+	case job.Context().Err() != nil:
+		status = slackbot.AuditCancelled
+	case ctx.Err() != nil:
+		status = slackbot.AuditTimedOut
+		err = fmt.Errorf("Killed after running for longer than its %s timeout", timeout)
+	case err != nil:
+		status = slackbot.AuditError
+	}
+	bot.FinishStatus(job.Request, status)
+	if err != nil {
+		msg := fmt.Sprintf("AutoBuild ERROR -- %s: %s", message, err.Error())
+		bot.Reply(req, msg)
+		return
 	}
+	bot.Reply(req, message)
 }
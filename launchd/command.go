@@ -4,8 +4,11 @@
 package launchd
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
+	"strings"
+	"time"
 )
 
 // StartCommand loads and starts a launchd job
@@ -24,18 +27,23 @@ func NewStartCommand(plistPath string, label string) StartCommand {
 
 // Run runs the exec command
 func (c StartCommand) Run(_ string, _ []string) (string, error) {
-	//nolint:gosec,noctx // launchctl is a trusted system binary with safe arguments, no context available
-	if _, err := exec.Command("/bin/launchctl", "unload", c.plistPath).CombinedOutput(); err != nil {
+	return c.RunContext(context.Background())
+}
+
+// RunContext runs the exec command, giving up on launchctl if ctx is cancelled
+func (c StartCommand) RunContext(ctx context.Context) (string, error) {
+	//nolint:gosec // launchctl is a trusted system binary with safe arguments
+	if _, err := exec.CommandContext(ctx, "/bin/launchctl", "unload", c.plistPath).CombinedOutput(); err != nil {
 		return "", fmt.Errorf("Error in launchctl unload: %s", err)
 	}
 
-	//nolint:gosec,noctx // launchctl is a trusted system binary with safe arguments, no context available
-	if _, err := exec.Command("/bin/launchctl", "load", c.plistPath).CombinedOutput(); err != nil {
+	//nolint:gosec // launchctl is a trusted system binary with safe arguments
+	if _, err := exec.CommandContext(ctx, "/bin/launchctl", "load", c.plistPath).CombinedOutput(); err != nil {
 		return "", fmt.Errorf("Error in launchctl load: %s", err)
 	}
 
-	//nolint:gosec,noctx // launchctl is a trusted system binary with safe arguments, no context available
-	if _, err := exec.Command("/bin/launchctl", "start", c.label).CombinedOutput(); err != nil {
+	//nolint:gosec // launchctl is a trusted system binary with safe arguments
+	if _, err := exec.CommandContext(ctx, "/bin/launchctl", "start", c.label).CombinedOutput(); err != nil {
 		return "", fmt.Errorf("Error in launchctl start: %s", err)
 	}
 
@@ -43,14 +51,44 @@ func (c StartCommand) Run(_ string, _ []string) (string, error) {
 }
 
 // Stop a launchd job
-func Stop(label string) (string, error) {
-	//nolint:noctx // launchctl is a trusted system binary, no context available
-	if _, err := exec.Command("/bin/launchctl", "stop", label).CombinedOutput(); err != nil {
+func Stop(ctx context.Context, label string) (string, error) {
+	if _, err := exec.CommandContext(ctx, "/bin/launchctl", "stop", label).CombinedOutput(); err != nil {
 		return "", fmt.Errorf("Error in launchctl stop: %s", err)
 	}
 	return fmt.Sprintf("I stopped the job `%s`.", label), nil
 }
 
+// IsRunning checks whether a launchd job has a running process
+func IsRunning(ctx context.Context, label string) (bool, error) {
+	out, err := exec.CommandContext(ctx, "/bin/launchctl", "list", label).CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// Not loaded
+			return false, nil
+		}
+		return false, fmt.Errorf("Error in launchctl list: %s", err)
+	}
+	return strings.Contains(string(out), `"PID" = `), nil
+}
+
+// Wait polls a launchd job until it is no longer running or ctx is done
+func Wait(ctx context.Context, label string, interval time.Duration) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		running, err := IsRunning(ctx, label)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return nil
+		}
+	}
+}
+
 // ShowResult decides whether to show the results from the exec
 func (c StartCommand) ShowResult() bool {
 	return false
@@ -0,0 +1,160 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLockBusy is returned when a command's lock is held and it doesn't queue
+var ErrLockBusy = errors.New("lock is busy")
+
+type lockWaiter struct {
+	job   *Job
+	ready chan struct{}
+}
+
+// locks are named resources (like "darwin-build") that only one job may hold
+// at a time. Jobs that want a held lock wait in line for it.
+type locks struct {
+	sync.Mutex
+	holders map[string]*Job
+	waiting map[string][]*lockWaiter
+}
+
+func newLocks() *locks {
+	return &locks{
+		holders: make(map[string]*Job),
+		waiting: make(map[string][]*lockWaiter),
+	}
+}
+
+// acquire takes the lock for job if it is free. Otherwise, if queue is set, it
+// puts job in line, marked as queued for the lock until release hands it over,
+// and returns the waiter, its 1-based position and the holder.
+func (l *locks) acquire(key string, job *Job, queue bool) (*lockWaiter, int, *Job) {
+	l.Lock()
+	defer l.Unlock()
+	holder, held := l.holders[key]
+	if !held {
+		l.holders[key] = job
+		return nil, 0, nil
+	}
+	if !queue {
+		return nil, 0, holder
+	}
+	waiter := &lockWaiter{job: job, ready: make(chan struct{})}
+	l.waiting[key] = append(l.waiting[key], waiter)
+	job.setQueued(key)
+	return waiter, len(l.waiting[key]), holder
+}
+
+// release gives up job's hold on, or place in line for, the lock. The next job
+// in line gets the lock.
+func (l *locks) release(key string, job *Job) {
+	l.Lock()
+	defer l.Unlock()
+	waiters := l.waiting[key]
+	for i, waiter := range waiters {
+		if waiter.job == job {
+			l.waiting[key] = append(waiters[:i:i], waiters[i+1:]...)
+			job.setQueued("")
+			return
+		}
+	}
+	if l.holders[key] != job {
+		return
+	}
+	delete(l.holders, key)
+	if len(waiters) == 0 {
+		return
+	}
+	next := waiters[0]
+	l.waiting[key] = waiters[1:]
+	l.holders[key] = next.job
+	next.job.setQueued("")
+	close(next.ready)
+}
+
+type queuedJob struct {
+	lock     string
+	position int
+	job      *Job
+}
+
+func (l *locks) queued() []queuedJob {
+	l.Lock()
+	defer l.Unlock()
+	var queued []queuedJob
+	for key, waiters := range l.waiting {
+		for i, waiter := range waiters {
+			queued = append(queued, queuedJob{lock: key, position: i + 1, job: waiter.job})
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].lock != queued[j].lock {
+			return queued[i].lock < queued[j].lock
+		}
+		return queued[i].position < queued[j].position
+	})
+	return queued
+}
+
+// LockJob waits for job to hold the named lock, announcing its place in line
+// if it has to wait. The returned unlock must be called when the job is done
+// with the lock. It fails if the job is cancelled while waiting.
+func (b *Bot) LockJob(job *Job, key string) (func(), error) {
+	return b.lockJob(job, key, true)
+}
+
+func (b *Bot) lockJob(job *Job, key string, queue bool) (func(), error) {
+	unlock := func() { b.locks.release(key, job) }
+	waiter, position, holder := b.locks.acquire(key, job, queue)
+	if holder == nil {
+		return unlock, nil
+	}
+	if waiter == nil {
+		b.Reply(job.Request, fmt.Sprintf("Sorry, `%s` is busy with job %s (`%s`), try again later.",
+			key, holder.ID, commandLine(holder.Request.Args)))
+		return nil, ErrLockBusy
+	}
+
+	b.jobs.Save()
+	b.Reply(job.Request, fmt.Sprintf("`%s` is busy with job %s (`%s`), so job %s is queued at position %d. See `!%s queue`.",
+		key, holder.ID, commandLine(holder.Request.Args), job.ID, position, b.name))
+	select {
+	case <-waiter.ready:
+		job.setQueued("")
+		log.Printf("Job %s acquired lock %s", job.ID, key)
+		b.jobs.Save()
+		return unlock, nil
+	case <-job.Context().Done():
+		unlock()
+		return nil, job.Context().Err()
+	}
+}
+
+func (b *Bot) listQueue(context.Context, Request) (string, error) {
+	queued := b.locks.queued()
+	if len(queued) == 0 {
+		return "Nothing is waiting.", nil
+	}
+	rows := [][]string{{"Lock", "#", "ID", "User", "Command", "Waiting for"}}
+	for _, q := range queued {
+		rows = append(rows, []string{q.lock, strconv.Itoa(q.position), q.job.ID, q.job.Request.Sender(),
+			commandLine(q.job.Request.Args), time.Since(q.job.Started).Round(time.Second).String()})
+	}
+	table, err := formatTable(rows)
+	if err != nil {
+		return "", err
+	}
+	return BlockQuote(table), nil
+}
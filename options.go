@@ -0,0 +1,56 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import "time"
+
+// CommandOptions are settings that apply to a trigger or subcommand path
+type CommandOptions struct {
+	// Confirm requires the sender to confirm with a token before it runs
+	Confirm bool
+	// ConfirmIf requires confirmation only for the args it returns true for,
+	// like a flag that turns something on
+	ConfirmIf func(args []string) bool
+	// Timeout cancels the command if it runs for longer, overriding the
+	// bot's default timeout when set
+	Timeout time.Duration
+	// Lock names a resource (like "darwin-build") that only one command may
+	// use at a time. Commands wait in line for a busy lock.
+	Lock string
+	// RejectWhenBusy turns commands away when their lock is busy instead of
+	// queueing them
+	RejectWhenBusy bool
+	// Transient commands (like restart) aren't offered to run again when a
+	// restart interrupts them
+	Transient bool
+}
+
+// SetOptions sets the options for a trigger or subcommand path like "release
+// promote". When several paths match a command, the longest one wins.
+func (b *Bot) SetOptions(path string, opts CommandOptions) {
+	b.options[path] = opts
+}
+
+func (b *Bot) optionsFor(args []string) CommandOptions {
+	_, opts, _ := matchPath(args, b.options)
+	return opts
+}
+
+// needsConfirmation checks whether args have to be confirmed before running
+func (opts CommandOptions) needsConfirmation(args []string) bool {
+	return opts.Confirm || (opts.ConfirmIf != nil && opts.ConfirmIf(args))
+}
+
+// SetDefaultTimeout sets how long commands may run for when their options
+// don't set a timeout. Zero means commands can run forever.
+func (b *Bot) SetDefaultTimeout(timeout time.Duration) {
+	b.defaultTimeout = timeout
+}
+
+func (b *Bot) timeoutFor(opts CommandOptions) time.Duration {
+	if opts.Timeout > 0 {
+		return opts.Timeout
+	}
+	return b.defaultTimeout
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import "log"
+
+// Reactions the bot puts on a command's message to show how it's going, on
+// backends that support them. They're emoji names without colons.
+const (
+	// ReactionReceived is added as soon as a command arrives
+	ReactionReceived = "eyes"
+	// ReactionRunning is shown while a job runs
+	ReactionRunning = "hourglass_flowing_sand"
+	// ReactionSucceeded is added when a command finishes successfully
+	ReactionSucceeded = "white_check_mark"
+	// ReactionFailed is added when a command fails, is denied or is cancelled
+	ReactionFailed = "x"
+)
+
+// reactor is a backend that can react to the message a request came from
+type reactor interface {
+	React(req Request, reaction string) error
+}
+
+// unreactor is a backend that can take its reactions back
+type unreactor interface {
+	Unreact(req Request, reaction string) error
+}
+
+// react adds a reaction to req's message, if the backend supports it
+func (b *Bot) react(req Request, reaction string) {
+	r, ok := b.backend.(reactor)
+	if !ok || req.MessageID == "" {
+		return
+	}
+	if err := r.React(req, reaction); err != nil {
+		log.Printf("Error reacting %s: %s", reaction, err)
+	}
+}
+
+// unreact removes a reaction from req's message, if the backend supports it
+func (b *Bot) unreact(req Request, reaction string) {
+	r, ok := b.backend.(unreactor)
+	if !ok || req.MessageID == "" {
+		return
+	}
+	if err := r.Unreact(req, reaction); err != nil {
+		log.Printf("Error removing reaction %s: %s", reaction, err)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"sync"
+)
+
+// BackendREPL is the backend name of requests typed into a REPLBackend
+const BackendREPL = "repl"
+
+// errInterrupt is returned by the line editor for ctrl-c
+var errInterrupt = errors.New("interrupted")
+
+// REPLBackend is a terminal backend for developing bots without a chat
+// service. Commands are typed with or without the "!bot" prefix, and messages
+// the bot would post are printed. On a terminal, lines can be edited and
+// earlier ones recalled with the arrow keys.
+type REPLBackend struct {
+	name   string
+	in     io.Reader
+	out    io.Writer
+	prompt string
+
+	mu      sync.Mutex
+	raw     bool
+	line    []rune
+	cursor  int
+	history []string
+}
+
+// NewREPLBackend reads commands for bot name from in and writes messages to
+// out
+func NewREPLBackend(name string, in io.Reader, out io.Writer) *REPLBackend {
+	return &REPLBackend{
+		name:   name,
+		in:     in,
+		out:    out,
+		prompt: name + "> ",
+	}
+}
+
+// NewREPLBackendFromEnv returns a REPL on stdin and stdout when SLACKBOT_REPL
+// is set, so bots can be tried out without chat tokens
+func NewREPLBackendFromEnv(name string) (*REPLBackend, bool) {
+	if os.Getenv("SLACKBOT_REPL") == "" {
+		return nil, false
+	}
+	return NewREPLBackend(name, os.Stdin, os.Stdout), true
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *REPLBackend) BackendName() string {
+	return BackendREPL
+}
+
+// SendMessage prints a message, redrawing the line being typed after it
+func (b *REPLBackend) SendMessage(text string, _ string) MessageHandle {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.raw {
+		fmt.Fprintln(b.out, text)
+		return MessageHandle{}
+	}
+	// Raw mode needs explicit carriage returns
+	fmt.Fprint(b.out, "\r\x1b[K"+strings.ReplaceAll(text, "\n", "\r\n")+"\r\n")
+	b.redrawLocked()
+	return MessageHandle{}
+}
+
+// Listen reads commands until EOF, ctrl-c or ctrl-d
+func (b *REPLBackend) Listen(runner BotCommandRunner) {
+	username := "developer"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	readLine := b.scanLine()
+	if f, ok := b.in.(*os.File); ok && isTerminal(f) {
+		restore, err := makeRaw(f)
+		if err != nil {
+			log.Printf("Line editing unavailable: %s", err)
+		} else {
+			defer restore()
+			// Keep log lines from staircasing while the terminal is raw
+			log.SetOutput(crlfWriter{os.Stderr})
+			defer log.SetOutput(os.Stderr)
+			b.mu.Lock()
+			b.raw = true
+			b.mu.Unlock()
+			reader := bufio.NewReader(f)
+			readLine = func() (string, error) { return b.editLine(reader) }
+		}
+	}
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			if err != io.EOF && err != errInterrupt {
+				log.Printf("Error reading input: %s", err)
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		b.addHistory(line)
+		args := parseInput(line)
+		if len(args) > 0 && args[0] == "!"+b.name {
+			args = args[1:]
+		}
+		req := Request{
+			Args:     args,
+			Backend:  BackendREPL,
+			Channel:  BackendREPL,
+			UserID:   username,
+			Username: username,
+			Text:     line,
+		}
+		if err := runner.RunCommand(req); err != nil {
+			b.SendMessage(err.Error(), req.Channel)
+		}
+	}
+}
+
+// scanLine reads plain lines, for input that isn't a terminal
+func (b *REPLBackend) scanLine() func() (string, error) {
+	scanner := bufio.NewScanner(b.in)
+	return func() (string, error) {
+		b.mu.Lock()
+		fmt.Fprint(b.out, b.prompt)
+		b.mu.Unlock()
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		}
+		return scanner.Text(), nil
+	}
+}
+
+func (b *REPLBackend) addHistory(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.history) == 0 || b.history[len(b.history)-1] != line {
+		b.history = append(b.history, line)
+	}
+}
+
+// editLine reads a line from a terminal in raw mode, handling arrow keys,
+// history and the usual emacs-style control keys
+func (b *REPLBackend) editLine(r *bufio.Reader) (string, error) {
+	b.mu.Lock()
+	b.line, b.cursor = nil, 0
+	histIndex := len(b.history)
+	b.redrawLocked()
+	b.mu.Unlock()
+
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		b.mu.Lock()
+		switch c {
+		case '\r', '\n':
+			line := string(b.line)
+			fmt.Fprint(b.out, "\r\n")
+			b.line, b.cursor = nil, 0
+			b.mu.Unlock()
+			return line, nil
+		case 3: // ctrl-c
+			fmt.Fprint(b.out, "\r\n")
+			b.mu.Unlock()
+			return "", errInterrupt
+		case 4: // ctrl-d
+			if len(b.line) == 0 {
+				fmt.Fprint(b.out, "\r\n")
+				b.mu.Unlock()
+				return "", io.EOF
+			}
+			b.deleteLocked()
+		case 1: // ctrl-a
+			b.cursor = 0
+		case 5: // ctrl-e
+			b.cursor = len(b.line)
+		case 21: // ctrl-u
+			b.line, b.cursor = b.line[b.cursor:], 0
+		case 127, 8: // backspace
+			if b.cursor > 0 {
+				b.cursor--
+				b.deleteLocked()
+			}
+		case 27: // escape sequence
+			b.mu.Unlock()
+			seq, err := readEscape(r)
+			if err != nil {
+				return "", err
+			}
+			b.mu.Lock()
+			switch seq {
+			case "[A": // up
+				if histIndex > 0 {
+					histIndex--
+					b.line = []rune(b.history[histIndex])
+					b.cursor = len(b.line)
+				}
+			case "[B": // down
+				if histIndex < len(b.history) {
+					histIndex++
+					b.line = nil
+					if histIndex < len(b.history) {
+						b.line = []rune(b.history[histIndex])
+					}
+					b.cursor = len(b.line)
+				}
+			case "[C": // right
+				b.cursor = min(b.cursor+1, len(b.line))
+			case "[D": // left
+				b.cursor = max(b.cursor-1, 0)
+			case "[H", "[1~":
+				b.cursor = 0
+			case "[F", "[4~":
+				b.cursor = len(b.line)
+			case "[3~":
+				b.deleteLocked()
+			}
+		default:
+			if c >= ' ' {
+				b.line = append(b.line[:b.cursor], append([]rune{c}, b.line[b.cursor:]...)...)
+				b.cursor++
+			}
+		}
+		b.redrawLocked()
+		b.mu.Unlock()
+	}
+}
+
+// readEscape reads the rest of an escape sequence after ESC, like "[A"
+func readEscape(r *bufio.Reader) (string, error) {
+	var seq []rune
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		seq = append(seq, c)
+		// Sequences end with a letter or ~, after the opening [ or O
+		if len(seq) > 1 && (c == '~' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')) {
+			return string(seq), nil
+		}
+		if len(seq) == 1 && c != '[' && c != 'O' {
+			return string(seq), nil
+		}
+	}
+}
+
+// deleteLocked deletes the rune under the cursor
+func (b *REPLBackend) deleteLocked() {
+	if b.cursor < len(b.line) {
+		b.line = append(b.line[:b.cursor], b.line[b.cursor+1:]...)
+	}
+}
+
+// redrawLocked redraws the prompt and line, putting the cursor in place
+func (b *REPLBackend) redrawLocked() {
+	fmt.Fprint(b.out, "\r\x1b[K"+b.prompt+string(b.line))
+	if back := len(b.line) - b.cursor; back > 0 {
+		fmt.Fprintf(b.out, "\x1b[%dD", back)
+	}
+}
+
+// crlfWriter writes \r\n for \n, for output to a raw terminal
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write([]byte(strings.ReplaceAll(string(p), "\n", "\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// makeRaw puts the terminal in raw mode with stty, returning a function that
+// restores it
+func makeRaw(f *os.File) (func(), error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...) //nolint:gosec // Arguments are flags or stty's own saved state
+		cmd.Stdin = f
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		if _, err := stty(saved); err != nil {
+			log.Printf("Error restoring terminal: %s", err)
+		}
+	}, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestREPLBackend(t *testing.T) {
+	in, input := io.Pipe()
+	out := &syncBuffer{}
+	backend := NewREPLBackend("testbot", in, out)
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.AddCommand("echo", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		return strings.Join(req.Args[1:], " ") + " from " + req.Backend, nil
+	}, "Echo", bot.Config()))
+	done := make(chan struct{})
+	go func() {
+		bot.Listen()
+		close(done)
+	}()
+
+	_, err := io.WriteString(input, "echo build darwin --skip-ci\n!testbot echo hi\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "build darwin --skip-ci from repl") &&
+			strings.Contains(out.String(), "hi from repl")
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, input.Close())
+	<-done
+	require.Equal(t, []string{"echo build darwin --skip-ci", "!testbot echo hi"}, backend.history)
+}
+
+func TestREPLLineEditing(t *testing.T) {
+	backend := NewREPLBackend("testbot", nil, io.Discard)
+	backend.history = []string{"build darwin", "date"}
+	cases := []struct {
+		input string
+		line  string
+	}{
+		{"abc\x1b[D\x1b[DX\r", "aXbc"},
+		{"abc\x7f\x7fz\r", "az"},
+		{"\x1b[A\r", "date"},
+		{"\x1b[A\x1b[A --test\r", "build darwin --test"},
+		{"\x1b[A\x1b[A\x1b[B\x1b[B\r", ""},
+		{"hello\x01\x1b[3~J\x05!\r", "Jello!"},
+		{"junk\x15ok\r", "ok"},
+	}
+	for _, c := range cases {
+		line, err := backend.editLine(bufio.NewReader(strings.NewReader(c.input)))
+		require.NoError(t, err)
+		require.Equal(t, c.line, line, "input %q", c.input)
+	}
+	_, err := backend.editLine(bufio.NewReader(strings.NewReader("\x04")))
+	require.ErrorIs(t, err, io.EOF)
+	_, err = backend.editLine(bufio.NewReader(strings.NewReader("abc\x03")))
+	require.ErrorIs(t, err, errInterrupt)
+}
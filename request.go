@@ -0,0 +1,92 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import "strings"
+
+// Backend names used in Request.Backend
+const (
+	BackendSlack   = "slack"
+	BackendKeybase = "keybase"
+)
+
+// Request is a command sent to the bot, along with where it came from
+type Request struct {
+	// Args are the parsed command arguments, without the "!bot" prefix
+	Args []string
+	// Backend is the name of the backend that received the command
+	Backend string
+	// Channel is the channel (or conversation ID) the command was sent in
+	Channel string
+	// UserID is the backend specific ID of the sender (Slack user ID, Keybase UID)
+	UserID string
+	// Username is the human readable name of the sender, if known
+	Username string
+	// MessageID identifies the message containing the command
+	MessageID string
+	// ThreadID identifies the thread the message belongs to, if any
+	ThreadID string
+	// Text is the raw message text
+	Text string
+	// JobID is set by the bot when the request runs as a job
+	JobID string
+	// ReplyURL is where a backend that has one sends the first reply, like a
+	// Slack slash command's response_url
+	ReplyURL string `json:"-"`
+
+	// Started, if set, is called with the job ID when the request starts
+	// running as a job
+	Started func(jobID string) `json:"-"`
+	// Done, if set, is called once with the outcome of the request, for
+	// backends that answer the sender directly rather than in chat
+	Done func(Result) `json:"-"`
+}
+
+// Result is the outcome of a request
+type Result struct {
+	JobID string
+	// Status is one of the Audit results, like AuditOK or AuditDenied
+	Status string
+	Output string
+	Err    error
+}
+
+// NewRequest returns a request with just args and a channel, for callers that
+// don't have a message to attribute the command to
+func NewRequest(channel string, args []string) Request {
+	return Request{
+		Args:    args,
+		Channel: channel,
+		Text:    strings.Join(args, " "),
+	}
+}
+
+// ChatMessage is a message someone sent in a channel, whether or not it was a
+// command
+type ChatMessage struct {
+	Backend  string
+	Channel  string
+	UserID   string
+	Username string
+	Text     string
+}
+
+// Sender describes who sent the message
+func (m ChatMessage) Sender() string {
+	if m.Username != "" {
+		return m.Username
+	}
+	return m.UserID
+}
+
+// Sender describes who sent the request, for logging
+func (r Request) Sender() string {
+	if r.Username != "" {
+		return r.Username
+	}
+	if r.UserID != "" {
+		return r.UserID
+	}
+	return "unknown"
+}
@@ -5,11 +5,18 @@ set -e -u -o pipefail # Fail on error
 dir=$( cd "$( dirname "${BASH_SOURCE[0]}" )" && pwd )
 cd "$dir"
 
-# send to keybase chat if we have it in the environment
+# send to keybase chat if we have it in the environment, to the first of the
+# bot's conversations (a conv ID or team#channel)
 convid=${KEYBASE_CHAT_CONVID:-}
+convid=${convid%%,*}
 if [ -n "$convid" ]; then
-  echo "Sending to Keybase convID: $convid"
+  echo "Sending to Keybase conversation: $convid"
   location=${KEYBASE_LOCATION:-"keybase"}
   home=${KEYBASE_HOME:-$HOME}
-  $location --home $home chat api -m "{\"method\":\"send\", \"params\": {\"options\": { \"conversation_id\": \"$convid\" , \"message\": { \"body\": \"$@\" }}}}"
+  if [[ "$convid" == *"#"* ]]; then
+    conv="\"channel\": {\"name\": \"${convid%%#*}\", \"members_type\": \"team\", \"topic_name\": \"${convid#*#}\"}"
+  else
+    conv="\"conversation_id\": \"$convid\""
+  fi
+  $location --home $home chat api -m "{\"method\":\"send\", \"params\": {\"options\": { $conv , \"message\": { \"body\": \"$@\" }}}}"
 fi
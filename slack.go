@@ -1,7 +1,13 @@
 package slackbot
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nlopes/slack"
 )
@@ -9,6 +15,12 @@ import (
 // SlackBotBackend is a Slack bot backend
 type SlackBotBackend struct { //nolint
 	api *slack.Client
+	// web sends messages and files with the Web API, which unlike the RTM
+	// session says which message was sent, so it can be edited
+	web   slackAPI
+	token string
+
+	mu  sync.Mutex
 	rtm *slack.RTM
 
 	channelIDs map[string]string
@@ -26,13 +38,20 @@ func NewSlackBotBackend(token string) (BotBackend, error) {
 
 	bot := &SlackBotBackend{}
 	bot.api = api
+	bot.web = slackAPI{url: slackAPIURL, client: &http.Client{Timeout: time.Minute}}
+	bot.token = token
 	bot.rtm = api.NewRTM()
 	bot.channelIDs = channelIDs
 	return bot, nil
 }
 
+// BackendName is the Request.Backend of requests from this backend
+func (b *SlackBotBackend) BackendName() string {
+	return BackendSlack
+}
+
 // SendMessage sends a message to a channel
-func (b *SlackBotBackend) SendMessage(text string, channel string) {
+func (b *SlackBotBackend) SendMessage(text string, channel string) MessageHandle {
 	cid := b.channelIDs[channel]
 	if cid == "" {
 		cid = channel
@@ -40,23 +59,52 @@ func (b *SlackBotBackend) SendMessage(text string, channel string) {
 
 	if channel == "" {
 		log.Printf("No channel to send message: %s", text)
-		return
+		return MessageHandle{}
 	}
 
-	if b.rtm != nil {
-		b.rtm.SendMessage(b.rtm.NewOutgoingMessage(text, cid))
-	} else {
-		log.Printf("Unable to send message: %s", text)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	handle, err := b.web.postMessage(ctx, b.token, cid, "", text, nil)
+	if err != nil {
+		log.Printf("Unable to send message: %s", err)
 	}
+	return handle
 }
 
-// Listen starts listening on the connection
+// EditMessage replaces the text of a message the bot sent
+func (b *SlackBotBackend) EditMessage(handle MessageHandle, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.web.updateMessage(ctx, b.token, handle, text)
+}
+
+// session returns the current RTM session
+func (b *SlackBotBackend) session() *slack.RTM {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rtm
+}
+
+// Restart replaces the RTM session, for listening again after Listen returns
+func (b *SlackBotBackend) Restart() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.rtm.Disconnect(); err != nil {
+		log.Printf("Error disconnecting from Slack: %s", err)
+	}
+	b.rtm = b.api.NewRTM()
+	return nil
+}
+
+// Listen handles messages until the credentials are rejected
 func (b *SlackBotBackend) Listen(runner BotCommandRunner) {
-	go b.rtm.ManageConnection()
+	rtm := b.session()
+	go rtm.ManageConnection()
 
 	auth, err := b.api.AuthTest()
 	if err != nil {
-		panic(err)
+		log.Printf("Slack auth test failed: %s", err)
+		return
 	}
 	// The Slack bot "tuxbot" should expect commands to start with "!tuxbot".
 	log.Printf("Connected to Slack as %q", auth.User)
@@ -64,17 +112,37 @@ func (b *SlackBotBackend) Listen(runner BotCommandRunner) {
 
 Loop:
 	for {
-		msg := <-b.rtm.IncomingEvents
+		msg := <-rtm.IncomingEvents
 		switch ev := msg.Data.(type) {
 		case *slack.HelloEvent:
 
 		case *slack.ConnectedEvent:
 
 		case *slack.MessageEvent:
+			// Only people's messages are observed, not edits, joins or bots'
+			// messages (including our own)
+			if ev.SubType == "" && ev.BotID == "" && ev.User != auth.UserID {
+				observeMessage(runner, ChatMessage{
+					Backend:  BackendSlack,
+					Channel:  ev.Channel,
+					UserID:   ev.User,
+					Username: b.userName(ev.User),
+					Text:     ev.Text,
+				})
+			}
 			args := parseInput(ev.Text)
 			if len(args) > 0 && args[0] == commandPrefix {
-				cmd := args[1:]
-				if err := runner.RunCommand(cmd, ev.Channel); err != nil {
+				req := Request{
+					Args:      args[1:],
+					Backend:   BackendSlack,
+					Channel:   ev.Channel,
+					UserID:    ev.User,
+					Username:  b.userName(ev.User),
+					MessageID: ev.Timestamp,
+					ThreadID:  ev.ThreadTimestamp,
+					Text:      ev.Text,
+				}
+				if err := runner.RunCommand(req); err != nil {
 					log.Printf("failed to run command: %s\n", err)
 				}
 			}
@@ -97,3 +165,73 @@ Loop:
 		}
 	}
 }
+
+// ReplyInThread replies in the thread of the message a request came from
+func (b *SlackBotBackend) ReplyInThread(req Request, text string) (MessageHandle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.web.postMessage(ctx, b.token, req.Channel, threadOf(req), text, nil)
+}
+
+// messageLimit is the longest message Slack shows in full
+func (b *SlackBotBackend) messageLimit(Request) int {
+	return slackMessageLimit
+}
+
+// messageFormat is Slack's mrkdwn
+func (b *SlackBotBackend) messageFormat(Request) Format {
+	return FormatSlack
+}
+
+// UploadFile uploads a file to the channel a request came from
+func (b *SlackBotBackend) UploadFile(req Request, name, title, content string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.web.uploadFile(ctx, b.token, req.Channel, req.ThreadID, name, title, content)
+}
+
+// React adds a reaction to the message a request came from
+func (b *SlackBotBackend) React(req Request, reaction string) error {
+	return b.api.AddReaction(reaction, slack.NewRefToMessage(req.Channel, req.MessageID))
+}
+
+// Unreact removes a reaction from the message a request came from
+func (b *SlackBotBackend) Unreact(req Request, reaction string) error {
+	return b.api.RemoveReaction(reaction, slack.NewRefToMessage(req.Channel, req.MessageID))
+}
+
+// channelID returns the ID of a channel name
+func (b *SlackBotBackend) channelID(name string) string {
+	return b.channelIDs[name]
+}
+
+// userName looks up the Slack username for a user ID from the RTM session
+func (b *SlackBotBackend) userName(userID string) string {
+	info := b.session().GetInfo()
+	if info == nil {
+		return ""
+	}
+	if user := info.GetUserByID(userID); user != nil {
+		return user.Name
+	}
+	return ""
+}
+
+// NewSlackBackendFromEnv picks a Slack backend from the environment. With
+// SLACK_SIGNING_SECRET it serves slash commands on SLACK_COMMANDS_ADDR (":3000"
+// by default), with SLACK_APP_TOKEN it uses Socket Mode, and otherwise RTM.
+// SLACK_TOKEN is the bot token, which slash commands only need for messages
+// sent to channels that haven't run a command.
+func NewSlackBackendFromEnv() (BotBackend, error) {
+	if secret := os.Getenv("SLACK_SIGNING_SECRET"); secret != "" {
+		addr := os.Getenv("SLACK_COMMANDS_ADDR")
+		if addr == "" {
+			addr = ":3000"
+		}
+		return NewSlackSlashCommandBackend(addr, secret, os.Getenv("SLACK_TOKEN")), nil
+	}
+	if appToken := strings.TrimSpace(os.Getenv("SLACK_APP_TOKEN")); appToken != "" {
+		return NewSlackSocketModeBackend(appToken, GetTokenFromEnv())
+	}
+	return NewSlackBotBackend(GetTokenFromEnv())
+}
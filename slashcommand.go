@@ -0,0 +1,347 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// slackSignatureMaxAge is how old a signed request can be, to stop replays
+	slackSignatureMaxAge = 5 * time.Minute
+	maxSlackRequestSize  = 1024 * 1024
+	// slackResponseURLLifetime is how long Slack accepts posts to a
+	// response_url
+	slackResponseURLLifetime = 30 * time.Minute
+)
+
+// SlackSlashCommandBackend is a Slack bot backend that serves an HTTP
+// endpoint for slash commands (/keybot build darwin) and interactive
+// payloads. The first reply to a command goes to its response_url, and the
+// rest, like a long build's output, are posted with the bot token.
+type SlackSlashCommandBackend struct {
+	addr          string
+	signingSecret string
+	api           slackAPI
+	botToken      string
+	now           func() time.Time
+
+	mu     sync.Mutex
+	runner BotCommandRunner
+	// responseURLs are the response_urls that haven't been replied to yet,
+	// with when they were received
+	responseURLs map[string]time.Time
+}
+
+// NewSlackSlashCommandBackend serves slash commands at /slack/commands and
+// interactive payloads at /slack/interactive on addr, checking requests are
+// signed with signingSecret. botToken is optional, but without it only the
+// response_url of a command can be used, which Slack limits to a few replies
+// in the first half hour.
+func NewSlackSlashCommandBackend(addr, signingSecret, botToken string) *SlackSlashCommandBackend {
+	return &SlackSlashCommandBackend{
+		addr:          addr,
+		signingSecret: signingSecret,
+		api:           slackAPI{url: slackAPIURL, client: &http.Client{Timeout: time.Minute}},
+		botToken:      botToken,
+		now:           time.Now,
+		responseURLs:  make(map[string]time.Time),
+	}
+}
+
+// Handler returns the HTTP handler for slash commands and interactive
+// payloads, sending commands to runner
+func (b *SlackSlashCommandBackend) Handler(runner BotCommandRunner) http.Handler {
+	b.mu.Lock()
+	b.runner = runner
+	b.mu.Unlock()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack/commands", b.handleCommand)
+	mux.HandleFunc("/slack/interactive", b.handleInteractive)
+	return mux
+}
+
+// Listen serves the HTTP endpoint
+func (b *SlackSlashCommandBackend) Listen(runner BotCommandRunner) {
+	server := &http.Server{
+		Addr:              b.addr,
+		Handler:           b.Handler(runner),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving Slack slash commands on %s", b.addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("Slack slash command server stopped: %s", err)
+	}
+}
+
+// verify checks the request's signature and timestamp, returning its body
+func (b *SlackSlashCommandBackend) verify(r *http.Request) ([]byte, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("Unexpected method %s", r.Method)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSlackRequestSize))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timestamp %q", timestamp)
+	}
+	if age := b.now().Sub(time.Unix(seconds, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return nil, fmt.Errorf("Request timestamp is %s off", age)
+	}
+	expected := slackSignature(b.signingSecret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return nil, fmt.Errorf("Invalid signature")
+	}
+	return body, nil
+}
+
+// slackSignature is the v0 signature Slack sends in X-Slack-Signature
+func slackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *SlackSlashCommandBackend) handleCommand(w http.ResponseWriter, r *http.Request) {
+	body, err := b.verify(r)
+	if err != nil {
+		log.Printf("Rejected slash command: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	responseURL := form.Get("response_url")
+	b.addResponseURL(responseURL)
+	text := form.Get("text")
+	// An empty 200 acknowledges the command without a visible reply; the
+	// output follows through the response_url. Slack gives up after three
+	// seconds, so the command runs after acknowledging it.
+	w.WriteHeader(http.StatusOK)
+	go b.run(Request{
+		Args:     parseInput(text),
+		Backend:  BackendSlack,
+		Channel:  form.Get("channel_id"),
+		UserID:   form.Get("user_id"),
+		Username: form.Get("user_name"),
+		Text:     strings.TrimSpace(form.Get("command") + " " + text),
+		ReplyURL: responseURL,
+	})
+}
+
+// interactivePayload is the part of a Slack interaction payload the backend
+// uses. Buttons carry the command to run in their value.
+type interactivePayload struct {
+	Type        string `json:"type"`
+	ResponseURL string `json:"response_url"`
+	User        struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Channel struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"channel"`
+	Container struct {
+		MessageTS string `json:"message_ts"`
+		ThreadTS  string `json:"thread_ts"`
+	} `json:"container"`
+	Actions []struct {
+		Value string `json:"value"`
+	} `json:"actions"`
+}
+
+func (b *SlackSlashCommandBackend) handleInteractive(w http.ResponseWriter, r *http.Request) {
+	body, err := b.verify(r)
+	if err != nil {
+		log.Printf("Rejected interactive payload: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var payload interactivePayload
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if payload.Type != "block_actions" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	b.addResponseURL(payload.ResponseURL)
+	var reqs []Request
+	for _, action := range payload.Actions {
+		if action.Value == "" {
+			continue
+		}
+		reqs = append(reqs, Request{
+			Args:      parseInput(action.Value),
+			Backend:   BackendSlack,
+			Channel:   payload.Channel.ID,
+			UserID:    payload.User.ID,
+			Username:  payload.User.Username,
+			MessageID: payload.Container.MessageTS,
+			ThreadID:  payload.Container.ThreadTS,
+			Text:      action.Value,
+			ReplyURL:  payload.ResponseURL,
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+	go func() {
+		for _, req := range reqs {
+			b.run(req)
+		}
+	}()
+}
+
+func (b *SlackSlashCommandBackend) run(req Request) {
+	b.mu.Lock()
+	runner := b.runner
+	b.mu.Unlock()
+	if err := runner.RunCommand(req); err != nil {
+		log.Printf("failed to run command: %s\n", err)
+		b.Reply(req, err.Error())
+	}
+}
+
+// addResponseURL records a command's response_url until it's replied to,
+// forgetting the ones Slack no longer accepts
+func (b *SlackSlashCommandBackend) addResponseURL(responseURL string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for u, received := range b.responseURLs {
+		if now.Sub(received) > slackResponseURLLifetime {
+			delete(b.responseURLs, u)
+		}
+	}
+	if responseURL != "" {
+		b.responseURLs[responseURL] = now
+	}
+}
+
+// takeResponseURL checks whether a response_url can still be used for a
+// first reply, so it's only used for that one
+func (b *SlackSlashCommandBackend) takeResponseURL(responseURL string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	received, ok := b.responseURLs[responseURL]
+	delete(b.responseURLs, responseURL)
+	return ok && b.now().Sub(received) <= slackResponseURLLifetime
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *SlackSlashCommandBackend) BackendName() string {
+	return BackendSlack
+}
+
+// Reply answers a command, through its response_url the first time, so the
+// sender sees it even if the bot isn't in the channel, and with the bot token
+// after that. Without a bot token the response_url is all there is. Only
+// messages posted with the bot token can be edited.
+func (b *SlackSlashCommandBackend) Reply(req Request, text string) MessageHandle {
+	if req.ReplyURL != "" && (b.takeResponseURL(req.ReplyURL) || b.botToken == "") {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		err := b.postResponse(ctx, req.ReplyURL, text)
+		if err == nil {
+			return MessageHandle{}
+		}
+		log.Printf("Unable to reply with response_url: %s", err)
+	}
+	return b.SendMessage(text, req.Channel)
+}
+
+// SendMessage posts in a channel with the bot token
+func (b *SlackSlashCommandBackend) SendMessage(text string, channel string) MessageHandle {
+	channel = strings.TrimPrefix(channel, "#")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if b.botToken == "" || channel == "" {
+		log.Printf("Unable to send message: %s", text)
+		return MessageHandle{}
+	}
+	handle, err := b.api.postMessage(ctx, b.botToken, channel, "", text, nil)
+	if err != nil {
+		log.Printf("Unable to send message: %s", err)
+	}
+	return handle
+}
+
+// EditMessage replaces the text of a message posted with the bot token
+func (b *SlackSlashCommandBackend) EditMessage(handle MessageHandle, text string) error {
+	if b.botToken == "" {
+		return ErrEditsUnsupported
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.api.updateMessage(ctx, b.botToken, handle, text)
+}
+
+// messageLimit is the longest message Slack shows in full
+func (b *SlackSlashCommandBackend) messageLimit(Request) int {
+	return slackMessageLimit
+}
+
+// messageFormat is Slack's mrkdwn
+func (b *SlackSlashCommandBackend) messageFormat(Request) Format {
+	return FormatSlack
+}
+
+// UploadFile uploads a file to the channel a request came from,
+// which needs the bot token
+func (b *SlackSlashCommandBackend) UploadFile(req Request, name, title, content string) error {
+	if b.botToken == "" {
+		return ErrUploadsUnsupported
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.api.uploadFile(ctx, b.botToken, req.Channel, req.ThreadID, name, title, content)
+}
+
+func (b *SlackSlashCommandBackend) postResponse(ctx context.Context, responseURL, text string) error {
+	body, err := json.Marshal(map[string]string{"response_type": "in_channel", "text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.api.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response_url: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingRunner struct {
+	requests chan Request
+}
+
+func (r recordingRunner) RunCommand(req Request) error {
+	r.requests <- req
+	return nil
+}
+
+func signedSlackRequest(t *testing.T, path, secret string, ts time.Time, form url.Values) *http.Request {
+	body := form.Encode()
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", slackSignature(secret, timestamp, []byte(body)))
+	return req
+}
+
+func TestSlackSlashCommandBackend(t *testing.T) {
+	responses := make(chan map[string]string, 10)
+	responseServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		responses <- body
+	}))
+	defer responseServer.Close()
+
+	now := time.Unix(1700000000, 0)
+	backend := NewSlackSlashCommandBackend("", "secret", "")
+	backend.now = func() time.Time { return now }
+	// Unbuffered, so a handler that waits for the command never returns
+	runner := recordingRunner{requests: make(chan Request)}
+	handler := backend.Handler(runner)
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(w, req)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Handler didn't acknowledge before running the command")
+		}
+		return w.Code
+	}
+
+	form := url.Values{
+		"command":      {"/keybot"},
+		"text":         {"build darwin --test"},
+		"user_id":      {"U1"},
+		"user_name":    {"alice"},
+		"channel_id":   {"C1"},
+		"channel_name": {"builds"},
+		"response_url": {responseServer.URL + "/command"},
+	}
+	require.Equal(t, http.StatusUnauthorized, serve(signedSlackRequest(t, "/slack/commands", "wrong", now, form)))
+	require.Equal(t, http.StatusUnauthorized, serve(signedSlackRequest(t, "/slack/commands", "secret", now.Add(-10*time.Minute), form)))
+	require.Empty(t, runner.requests)
+
+	require.Equal(t, http.StatusOK, serve(signedSlackRequest(t, "/slack/commands", "secret", now, form)))
+	cmd := <-runner.requests
+	require.Equal(t, Request{
+		Args:     []string{"build", "darwin", "--test"},
+		Backend:  BackendSlack,
+		Channel:  "C1",
+		UserID:   "U1",
+		Username: "alice",
+		Text:     "/keybot build darwin --test",
+		ReplyURL: responseServer.URL + "/command",
+	}, cmd)
+
+	// Without a bot token, the response_url is the only way to reply
+	backend.Reply(cmd, "Building")
+	require.Equal(t, map[string]string{"response_type": "in_channel", "text": "Building"}, <-responses)
+	backend.Reply(cmd, "Still building")
+	require.Equal(t, "Still building", (<-responses)["text"])
+
+	payload, err := json.Marshal(map[string]any{
+		"type":         "block_actions",
+		"response_url": responseServer.URL + "/action",
+		"user":         map[string]string{"id": "U2", "username": "bob"},
+		"channel":      map[string]string{"id": "C2", "name": "releases"},
+		"container":    map[string]string{"message_ts": "1.2"},
+		"actions":      []map[string]string{{"value": "release promote darwin 1.2.3"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, serve(signedSlackRequest(t, "/slack/interactive", "secret", now,
+		url.Values{"payload": {string(payload)}})))
+	req := <-runner.requests
+	require.Equal(t, []string{"release", "promote", "darwin", "1.2.3"}, req.Args)
+	require.Equal(t, "bob", req.Username)
+	require.Equal(t, "1.2", req.MessageID)
+	require.Equal(t, responseServer.URL+"/action", req.ReplyURL)
+}
+
+func TestSlashCommandReplies(t *testing.T) {
+	sent := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			require.NoError(t, r.ParseForm())
+			sent <- r.URL.Path + " " + r.Form.Get("text")
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"ok": true, "channel": r.Form.Get("channel"), "ts": "1.1"}))
+			return
+		}
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		sent <- r.URL.Path + " " + body["text"]
+	}))
+	defer server.Close()
+
+	now := time.Unix(1700000000, 0)
+	backend := NewSlackSlashCommandBackend("", "secret", "xoxb-token")
+	backend.api.url = server.URL + "/api/"
+	backend.now = func() time.Time { return now }
+	runner := recordingRunner{requests: make(chan Request, 2)}
+	handler := backend.Handler(runner)
+	command := func(responseURL string) Request {
+		form := url.Values{"text": {"build"}, "channel_id": {"C1"}, "response_url": {server.URL + responseURL}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, signedSlackRequest(t, "/slack/commands", "secret", now, form))
+		require.Equal(t, http.StatusOK, w.Code)
+		return <-runner.requests
+	}
+
+	// Each command is acknowledged through its own response_url, even with
+	// another running in the channel, and the rest is posted with the token
+	first := command("/first")
+	second := command("/second")
+	backend.Reply(first, "Building")
+	require.Equal(t, "/first Building", <-sent)
+	backend.Reply(second, "Building too")
+	require.Equal(t, "/second Building too", <-sent)
+	handle := backend.Reply(first, "Built")
+	require.Equal(t, "/api/chat.postMessage Built", <-sent)
+	require.True(t, handle.Valid())
+
+	// Slack stops accepting a response_url after a while
+	third := command("/third")
+	now = now.Add(time.Hour)
+	backend.Reply(third, "Building")
+	require.Equal(t, "/api/chat.postMessage Building", <-sent)
+}
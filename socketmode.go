@@ -0,0 +1,494 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const slackAPIURL = "https://slack.com/api/"
+
+// errInvalidAuth means Slack rejected a token, so reconnecting won't help
+var errInvalidAuth = errors.New("invalid auth")
+
+// slackAPI is a minimal client for the Slack Web API methods the Socket Mode
+// backend needs
+type slackAPI struct {
+	url    string
+	client *http.Client
+}
+
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// call POSTs params to a Web API method with token, decoding the response
+// into out
+func (a slackAPI) call(ctx context.Context, token, method string, params url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("%s: %s", method, err)
+	}
+	var status slackResponse
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return fmt.Errorf("%s: %s", method, err)
+	}
+	if !status.OK {
+		if status.Error == "invalid_auth" || status.Error == "not_authed" || status.Error == "account_inactive" {
+			return fmt.Errorf("%s: %w", method, errInvalidAuth)
+		}
+		return fmt.Errorf("%s: %s", method, status.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// postMessage posts text to a channel, in thread if it isn't empty, with
+// extra params like blocks
+func (a slackAPI) postMessage(ctx context.Context, token, channel, thread, text string, extra url.Values) (MessageHandle, error) {
+	params := url.Values{"channel": {channel}, "text": {text}}
+	if thread != "" {
+		params.Set("thread_ts", thread)
+	}
+	for key, values := range extra {
+		params[key] = values
+	}
+	var posted struct {
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	}
+	if err := a.call(ctx, token, "chat.postMessage", params, &posted); err != nil {
+		return MessageHandle{}, err
+	}
+	return MessageHandle{Backend: BackendSlack, Channel: posted.Channel, ID: posted.TS}, nil
+}
+
+// updateMessage replaces the text of a message the bot posted
+func (a slackAPI) updateMessage(ctx context.Context, token string, handle MessageHandle, text string) error {
+	params := url.Values{"channel": {handle.Channel}, "ts": {handle.ID}, "text": {text}}
+	return a.call(ctx, token, "chat.update", params, nil)
+}
+
+// uploadFile uploads content as a file named name to a channel, in thread if
+// it isn't empty. The bot token needs the files:write scope.
+func (a slackAPI) uploadFile(ctx context.Context, token, channel, thread, name, title, content string) error {
+	var upload struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	params := url.Values{"filename": {name}, "length": {strconv.Itoa(len(content))}}
+	if err := a.call(ctx, token, "files.getUploadURLExternal", params, &upload); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upload.UploadURL, strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Uploading %s: %s", name, resp.Status)
+	}
+	if title == "" {
+		title = name
+	}
+	files, err := json.Marshal([]map[string]string{{"id": upload.FileID, "title": title}})
+	if err != nil {
+		return err
+	}
+	params = url.Values{"files": {string(files)}, "channel_id": {channel}}
+	if thread != "" {
+		params.Set("thread_ts", thread)
+	}
+	return a.call(ctx, token, "files.completeUploadExternal", params, nil)
+}
+
+// socketEnvelope is a message from Slack over a Socket Mode connection
+type socketEnvelope struct {
+	Type       string `json:"type"`
+	EnvelopeID string `json:"envelope_id"`
+	Reason     string `json:"reason"`
+	Payload    struct {
+		Event slackEvent `json:"event"`
+	} `json:"payload"`
+}
+
+// slackEvent is an Events API event
+type slackEvent struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// SlackSocketModeBackend is a Slack bot backend that receives events over
+// Socket Mode and sends messages with the Web API
+type SlackSocketModeBackend struct {
+	api      slackAPI
+	appToken string
+	botToken string
+
+	channelIDs map[string]string
+	botUserID  string
+	botName    string
+
+	mu        sync.Mutex
+	userNames map[string]string
+	// seen are the envelopes handled recently, since Slack redelivers ones
+	// it thinks weren't acknowledged
+	seen      map[string]bool
+	seenOrder []string
+}
+
+// maxSeenEnvelopes is how many envelope IDs are kept to skip redeliveries
+const maxSeenEnvelopes = 1000
+
+// socketEventQueue is how many events can wait to be handled before the
+// connection stops reading
+const socketEventQueue = 100
+
+// NewSlackSocketModeBackend constructs a bot backend from a Slack app-level
+// token (xapp-, with connections:write) and bot token (xoxb-)
+func NewSlackSocketModeBackend(appToken, botToken string) (BotBackend, error) {
+	return newSlackSocketModeBackend(appToken, botToken, slackAPIURL)
+}
+
+func newSlackSocketModeBackend(appToken, botToken, apiURL string) (*SlackSocketModeBackend, error) {
+	b := &SlackSocketModeBackend{
+		api:       slackAPI{url: apiURL, client: &http.Client{Timeout: time.Minute}},
+		appToken:  appToken,
+		botToken:  botToken,
+		userNames: make(map[string]string),
+		seen:      make(map[string]bool),
+	}
+	ctx := context.Background()
+	var auth struct {
+		User   string `json:"user"`
+		UserID string `json:"user_id"`
+	}
+	if err := b.api.call(ctx, botToken, "auth.test", nil, &auth); err != nil {
+		return nil, err
+	}
+	b.botName = auth.User
+	b.botUserID = auth.UserID
+	channelIDs, err := b.loadChannelIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.channelIDs = channelIDs
+	return b, nil
+}
+
+// loadChannelIDs maps channel names to IDs, a page at a time
+func (b *SlackSocketModeBackend) loadChannelIDs(ctx context.Context) (map[string]string, error) {
+	channelIDs := make(map[string]string)
+	cursor := ""
+	for {
+		var page struct {
+			Channels []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"channels"`
+			ResponseMetadata struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"response_metadata"`
+		}
+		params := url.Values{
+			"exclude_archived": {"true"},
+			"limit":            {"200"},
+			"types":            {"public_channel,private_channel"},
+		}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		if err := b.api.call(ctx, b.botToken, "conversations.list", params, &page); err != nil {
+			return nil, err
+		}
+		for _, c := range page.Channels {
+			channelIDs[c.Name] = c.ID
+		}
+		cursor = page.ResponseMetadata.NextCursor
+		if cursor == "" {
+			return channelIDs, nil
+		}
+	}
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *SlackSocketModeBackend) BackendName() string {
+	return BackendSlack
+}
+
+// SendMessage sends a message to a channel
+func (b *SlackSocketModeBackend) SendMessage(text string, channel string) MessageHandle {
+	if channel == "" {
+		log.Printf("No channel to send message: %s", text)
+		return MessageHandle{}
+	}
+	cid := b.channelIDs[channel]
+	if cid == "" {
+		cid = channel
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	handle, err := b.api.postMessage(ctx, b.botToken, cid, "", text, nil)
+	if err != nil {
+		log.Printf("Unable to send message: %s", err)
+	}
+	return handle
+}
+
+// EditMessage replaces the text of a message the bot sent
+func (b *SlackSocketModeBackend) EditMessage(handle MessageHandle, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.api.updateMessage(ctx, b.botToken, handle, text)
+}
+
+// Listen receives events until Slack rejects the app token, reconnecting when
+// the connection drops or Slack asks for a refresh
+func (b *SlackSocketModeBackend) Listen(runner BotCommandRunner) {
+	log.Printf("Connected to Slack as %q", b.botName)
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := b.listenOnce(runner)
+		if errors.Is(err, errInvalidAuth) {
+			log.Printf("Invalid credentials: %s", err)
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Socket Mode connection closed (%v), reconnecting in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// listenOnce opens a Socket Mode connection and handles envelopes until it
+// closes
+func (b *SlackSocketModeBackend) listenOnce(runner BotCommandRunner) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var open struct {
+		URL string `json:"url"`
+	}
+	if err := b.api.call(ctx, b.appToken, "apps.connections.open", nil, &open); err != nil {
+		return err
+	}
+	config, err := websocket.NewConfig(open.URL, "https://slack.com")
+	if err != nil {
+		return err
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	// Events are handled off the read loop, in order, so looking up users
+	// and running commands doesn't hold up acknowledging later envelopes
+	events := make(chan slackEvent, socketEventQueue)
+	defer close(events)
+	go func() {
+		for ev := range events {
+			b.handleEvent(ev, runner)
+		}
+	}()
+
+	for {
+		var envelope socketEnvelope
+		if err := websocket.JSON.Receive(ws, &envelope); err != nil {
+			return err
+		}
+		if envelope.EnvelopeID != "" {
+			ack := struct {
+				EnvelopeID string `json:"envelope_id"`
+			}{envelope.EnvelopeID}
+			if err := websocket.JSON.Send(ws, ack); err != nil {
+				return err
+			}
+			if b.redelivered(envelope.EnvelopeID) {
+				continue
+			}
+		}
+		switch envelope.Type {
+		case "hello":
+		case "disconnect":
+			return fmt.Errorf("disconnect requested: %s", envelope.Reason)
+		case "events_api":
+			events <- envelope.Payload.Event
+		}
+	}
+}
+
+// redelivered checks whether an envelope was already handled, remembering it
+// if not
+func (b *SlackSocketModeBackend) redelivered(envelopeID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen[envelopeID] {
+		return true
+	}
+	b.seen[envelopeID] = true
+	b.seenOrder = append(b.seenOrder, envelopeID)
+	if len(b.seenOrder) > maxSeenEnvelopes {
+		delete(b.seen, b.seenOrder[0])
+		b.seenOrder = b.seenOrder[1:]
+	}
+	return false
+}
+
+func (b *SlackSocketModeBackend) handleEvent(ev slackEvent, runner BotCommandRunner) {
+	// Skip edits, joins and other bots' messages, as well as our own
+	if ev.Type != "message" || ev.Subtype != "" || ev.BotID != "" || ev.User == b.botUserID {
+		return
+	}
+	username := b.userName(ev.User)
+	observeMessage(runner, ChatMessage{
+		Backend:  BackendSlack,
+		Channel:  ev.Channel,
+		UserID:   ev.User,
+		Username: username,
+		Text:     ev.Text,
+	})
+	args := parseInput(ev.Text)
+	if len(args) == 0 || args[0] != "!"+b.botName {
+		return
+	}
+	req := Request{
+		Args:      args[1:],
+		Backend:   BackendSlack,
+		Channel:   ev.Channel,
+		UserID:    ev.User,
+		Username:  username,
+		MessageID: ev.TS,
+		ThreadID:  ev.ThreadTS,
+		Text:      ev.Text,
+	}
+	if err := runner.RunCommand(req); err != nil {
+		log.Printf("failed to run command: %s\n", err)
+	}
+}
+
+// ReplyInThread replies in the thread of the message a request came from
+func (b *SlackSocketModeBackend) ReplyInThread(req Request, text string) (MessageHandle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.api.postMessage(ctx, b.botToken, req.Channel, threadOf(req), text, nil)
+}
+
+// messageLimit is the longest message Slack shows in full
+func (b *SlackSocketModeBackend) messageLimit(Request) int {
+	return slackMessageLimit
+}
+
+// messageFormat is Slack's mrkdwn
+func (b *SlackSocketModeBackend) messageFormat(Request) Format {
+	return FormatSlack
+}
+
+// sendBlocks posts Block Kit blocks to the channel a request came from
+func (b *SlackSocketModeBackend) sendBlocks(req Request, blocks []map[string]any, text string) error {
+	encoded, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err = b.api.postMessage(ctx, b.botToken, req.Channel, req.ThreadID, text, url.Values{"blocks": {string(encoded)}})
+	return err
+}
+
+// UploadFile uploads a file to the channel a request came from
+func (b *SlackSocketModeBackend) UploadFile(req Request, name, title, content string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return b.api.uploadFile(ctx, b.botToken, req.Channel, req.ThreadID, name, title, content)
+}
+
+// React adds a reaction to the message a request came from
+func (b *SlackSocketModeBackend) React(req Request, reaction string) error {
+	return b.reaction("reactions.add", req, reaction)
+}
+
+// Unreact removes a reaction from the message a request came from
+func (b *SlackSocketModeBackend) Unreact(req Request, reaction string) error {
+	return b.reaction("reactions.remove", req, reaction)
+}
+
+func (b *SlackSocketModeBackend) reaction(method string, req Request, reaction string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	params := url.Values{"channel": {req.Channel}, "timestamp": {req.MessageID}, "name": {reaction}}
+	return b.api.call(ctx, b.botToken, method, params, nil)
+}
+
+// channelID returns the ID of a channel name
+func (b *SlackSocketModeBackend) channelID(name string) string {
+	return b.channelIDs[name]
+}
+
+// userName looks up the Slack username for a user ID, caching the result
+func (b *SlackSocketModeBackend) userName(userID string) string {
+	b.mu.Lock()
+	name, ok := b.userNames[userID]
+	b.mu.Unlock()
+	if ok {
+		return name
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var info struct {
+		User struct {
+			Name string `json:"name"`
+		} `json:"user"`
+	}
+	if err := b.api.call(ctx, b.botToken, "users.info", url.Values{"user": {userID}}, &info); err != nil {
+		log.Printf("Error looking up user %s: %s", userID, err)
+		return ""
+	}
+	b.mu.Lock()
+	b.userNames[userID] = info.User.Name
+	b.mu.Unlock()
+	return info.User.Name
+}
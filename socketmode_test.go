@@ -0,0 +1,239 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// fakeSlack stands in for the Slack Web API and Socket Mode
+type fakeSlack struct {
+	server   *httptest.Server
+	posted   chan map[string]string
+	updated  chan map[string]string
+	uploaded chan map[string]string
+	acks     chan string
+	sockets  chan *websocket.Conn
+	// unblock lets lookups of the user USLOW finish
+	unblock chan struct{}
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{
+		posted:   make(chan map[string]string, 10),
+		updated:  make(chan map[string]string, 10),
+		uploaded: make(chan map[string]string, 10),
+		acks:     make(chan string, 10),
+		sockets:  make(chan *websocket.Conn, 10),
+		unblock:  make(chan struct{}),
+	}
+	reply := func(w http.ResponseWriter, body map[string]any) {
+		body["ok"] = true
+		require.NoError(t, json.NewEncoder(w).Encode(body))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth.test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-bot" {
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": "invalid_auth"}))
+			return
+		}
+		reply(w, map[string]any{"user": "testbot", "user_id": "UBOT"})
+	})
+	mux.HandleFunc("/api/conversations.list", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.Form.Get("cursor") == "" {
+			reply(w, map[string]any{
+				"channels":          []map[string]string{{"id": "C1", "name": "general"}},
+				"response_metadata": map[string]string{"next_cursor": "next"},
+			})
+			return
+		}
+		reply(w, map[string]any{"channels": []map[string]string{{"id": "C2", "name": "builds"}}})
+	})
+	mux.HandleFunc("/api/users.info", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.Form.Get("user") == "USLOW" {
+			<-f.unblock
+		}
+		reply(w, map[string]any{"user": map[string]string{"name": "name-" + r.Form.Get("user")}})
+	})
+	mux.HandleFunc("/api/chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		posted := map[string]string{"channel": r.Form.Get("channel"), "text": r.Form.Get("text")}
+		if blocks := r.Form.Get("blocks"); blocks != "" {
+			posted["blocks"] = blocks
+		}
+		f.posted <- posted
+		reply(w, map[string]any{"channel": r.Form.Get("channel"), "ts": "1.1"})
+	})
+	mux.HandleFunc("/api/chat.update", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		f.updated <- map[string]string{"channel": r.Form.Get("channel"), "ts": r.Form.Get("ts"), "text": r.Form.Get("text")}
+		reply(w, map[string]any{})
+	})
+	mux.HandleFunc("/api/files.getUploadURLExternal", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		reply(w, map[string]any{"upload_url": f.server.URL + "/upload/" + r.Form.Get("filename"), "file_id": "F1"})
+	})
+	mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		f.uploaded <- map[string]string{"name": strings.TrimPrefix(r.URL.Path, "/upload/"), "content": string(body)}
+	})
+	mux.HandleFunc("/api/files.completeUploadExternal", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		f.uploaded <- map[string]string{"files": r.Form.Get("files"), "channel_id": r.Form.Get("channel_id"), "thread_ts": r.Form.Get("thread_ts")}
+		reply(w, map[string]any{})
+	})
+	mux.HandleFunc("/api/apps.connections.open", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer xapp-app", r.Header.Get("Authorization"))
+		reply(w, map[string]any{"url": "ws" + strings.TrimPrefix(f.server.URL, "http") + "/socket"})
+	})
+	mux.Handle("/socket", websocket.Handler(func(ws *websocket.Conn) {
+		f.sockets <- ws
+		for {
+			var ack struct {
+				EnvelopeID string `json:"envelope_id"`
+			}
+			if err := websocket.JSON.Receive(ws, &ack); err != nil {
+				return
+			}
+			f.acks <- ack.EnvelopeID
+		}
+	}))
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-f.unblock:
+		default:
+			close(f.unblock)
+		}
+	})
+	return f
+}
+
+func (f *fakeSlack) socket(t *testing.T) *websocket.Conn {
+	select {
+	case ws := <-f.sockets:
+		return ws
+	case <-time.After(5 * time.Second):
+		t.Fatal("No Socket Mode connection")
+		return nil
+	}
+}
+
+func (f *fakeSlack) sendEvent(t *testing.T, ws *websocket.Conn, id string, event map[string]string) {
+	require.NoError(t, websocket.JSON.Send(ws, map[string]any{
+		"type":        "events_api",
+		"envelope_id": id,
+		"payload":     map[string]any{"event": event},
+	}))
+	select {
+	case ack := <-f.acks:
+		require.Equal(t, id, ack)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Envelope %s wasn't acknowledged", id)
+	}
+}
+
+func TestSlackSocketModeBackend(t *testing.T) {
+	f := newFakeSlack(t)
+	_, err := newSlackSocketModeBackend("xapp-app", "xoxb-wrong", f.server.URL+"/api/")
+	require.ErrorIs(t, err, errInvalidAuth)
+
+	backend, err := newSlackSocketModeBackend("xapp-app", "xoxb-bot", f.server.URL+"/api/")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"general": "C1", "builds": "C2"}, backend.channelIDs)
+
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.AddCommand("whoami", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		return req.Username + " in " + req.Channel, nil
+	}, "Who am I", bot.Config()))
+	go bot.Listen()
+
+	ws := f.socket(t)
+	require.NoError(t, websocket.JSON.Send(ws, map[string]any{"type": "hello"}))
+	// Our own messages and edits are ignored
+	f.sendEvent(t, ws, "1", map[string]string{"type": "message", "user": "UBOT", "channel": "C2", "text": "!testbot whoami"})
+	f.sendEvent(t, ws, "2", map[string]string{"type": "message", "subtype": "message_changed", "user": "U1", "channel": "C2", "text": "!testbot whoami"})
+	f.sendEvent(t, ws, "3", map[string]string{"type": "message", "user": "U1", "channel": "C2", "text": "!testbot whoami", "ts": "1.2"})
+	select {
+	case posted := <-f.posted:
+		require.Equal(t, map[string]string{"channel": "C2", "text": "name-U1 in C2"}, posted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No reply posted")
+	}
+
+	// A redelivered envelope is acknowledged but not run again, and a slow
+	// user lookup doesn't hold up acknowledging later envelopes
+	f.sendEvent(t, ws, "3", map[string]string{"type": "message", "user": "U1", "channel": "C2", "text": "!testbot whoami", "ts": "1.2"})
+	f.sendEvent(t, ws, "5", map[string]string{"type": "message", "user": "USLOW", "channel": "C2", "text": "!testbot whoami", "ts": "1.3"})
+	f.sendEvent(t, ws, "6", map[string]string{"type": "message", "user": "U3", "channel": "C2", "text": "hello"})
+	close(f.unblock)
+	select {
+	case posted := <-f.posted:
+		require.Equal(t, map[string]string{"channel": "C2", "text": "name-USLOW in C2"}, posted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No reply posted")
+	}
+
+	// A refresh request reconnects
+	require.NoError(t, websocket.JSON.Send(ws, map[string]any{"type": "disconnect", "reason": "refresh_requested"}))
+	ws = f.socket(t)
+	f.sendEvent(t, ws, "4", map[string]string{"type": "message", "user": "U2", "channel": "C1", "text": "!testbot whoami"})
+	select {
+	case posted := <-f.posted:
+		require.Equal(t, map[string]string{"channel": "C1", "text": "name-U2 in C1"}, posted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No reply posted after reconnecting")
+	}
+
+	backend.SendMessage("hi", "builds")
+	require.Equal(t, map[string]string{"channel": "C2", "text": "hi"}, <-f.posted)
+}
+
+func TestSlackUpload(t *testing.T) {
+	f := newFakeSlack(t)
+	backend, err := newSlackSocketModeBackend("xapp-app", "xoxb-bot", f.server.URL+"/api/")
+	require.NoError(t, err)
+	require.NoError(t, backend.UploadFile(Request{Channel: "C2", ThreadID: "1.2"}, "log-1.txt", "Build log", "lots of output"))
+	require.Equal(t, map[string]string{"name": "log-1.txt", "content": "lots of output"}, <-f.uploaded)
+	require.Equal(t, map[string]string{"files": `[{"id":"F1","title":"Build log"}]`, "channel_id": "C2", "thread_ts": "1.2"}, <-f.uploaded)
+}
+
+func TestSlackEdit(t *testing.T) {
+	f := newFakeSlack(t)
+	backend, err := newSlackSocketModeBackend("xapp-app", "xoxb-bot", f.server.URL+"/api/")
+	require.NoError(t, err)
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	handle := bot.SendMessage("building", "C2")
+	require.Equal(t, MessageHandle{Backend: BackendSlack, Channel: "C2", ID: "1.1"}, handle)
+	<-f.posted
+	require.NoError(t, bot.EditMessage(handle, "built"))
+	require.Equal(t, map[string]string{"channel": "C2", "ts": "1.1", "text": "built"}, <-f.updated)
+}
+
+func TestSlackBlocks(t *testing.T) {
+	f := newFakeSlack(t)
+	backend, err := newSlackSocketModeBackend("xapp-app", "xoxb-bot", f.server.URL+"/api/")
+	require.NoError(t, err)
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.ReplyDocument(Request{Channel: "C2"}, Document{Paragraph{Strong("Done")}})
+	require.Equal(t, map[string]string{
+		"channel": "C2",
+		"text":    "*Done*",
+		"blocks":  `[{"text":{"text":"*Done*","type":"mrkdwn"},"type":"section"}]`,
+	}, <-f.posted)
+}
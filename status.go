@@ -0,0 +1,102 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultStatusInterval is how often a job's status message is updated with
+// how long it's been running
+const DefaultStatusInterval = time.Minute
+
+// SetStatusInterval sets how often status messages are updated
+func (b *Bot) SetStatusInterval(interval time.Duration) {
+	b.statusInterval = interval
+}
+
+// Status tells the channel a job was run from what it's doing, like "running
+// tests". A job has one status message, which is edited for each phase, as
+// time passes and with the result when the job finishes. Backends that can't
+// edit messages get a new message for each phase instead.
+func (b *Bot) Status(req Request, phase string) {
+	job, ok := b.jobs.Get(req.JobID)
+	if !ok {
+		b.Reply(req, phase)
+		return
+	}
+	job.setPhase(phase)
+	b.updateStatus(job, statusText(job), true)
+}
+
+// updateStatus edits a job's status message, sending it if there isn't one
+// yet and send is set
+func (b *Bot) updateStatus(job *Job, text string, send bool) {
+	job.statusMu.Lock()
+	defer job.statusMu.Unlock()
+	if job.statusDone {
+		return
+	}
+	if job.statusMessage.Valid() {
+		err := b.EditMessage(job.statusMessage, text)
+		if err == nil {
+			return
+		}
+		log.Printf("Error editing status of job %s: %s", job.ID, err)
+	}
+	if send {
+		job.statusMessage = b.replyMessage(job.Request, text)
+	}
+}
+
+// statusText describes a running job
+func statusText(job *Job) string {
+	return fmt.Sprintf("Job %s (`%s`) for %s: %s (%s so far)", job.ID, commandLine(job.Request.Args),
+		job.Request.Sender(), job.Phase(), time.Since(job.Started).Round(time.Second))
+}
+
+// refreshStatus updates a job's status message with how long it's been
+// running, until the job ends
+func (b *Bot) refreshStatus(job *Job) {
+	if b.statusInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(b.statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.Context().Done():
+			return
+		case <-ticker.C:
+			if job.Phase() != "" {
+				b.updateStatus(job, statusText(job), false)
+			}
+		}
+	}
+}
+
+// FinishStatus edits the status message of the job req ran as, if it has
+// one, to say how the job ended, with status one of the Audit results. The
+// bot does this for the jobs it runs; jobs started with Jobs().Start do it
+// themselves before they finish.
+func (b *Bot) FinishStatus(req Request, status string) {
+	job, ok := b.jobs.Get(req.JobID)
+	if !ok {
+		return
+	}
+	job.statusMu.Lock()
+	defer job.statusMu.Unlock()
+	job.statusDone = true
+	if !job.statusMessage.Valid() {
+		return
+	}
+	text := fmt.Sprintf("Job %s (`%s`) for %s %s after %s.", job.ID, commandLine(job.Request.Args),
+		job.Request.Sender(), jobOutcome(status), time.Since(job.Started).Round(time.Second))
+	if err := b.EditMessage(job.statusMessage, text); err != nil && !errors.Is(err, ErrEditsUnsupported) {
+		log.Printf("Error editing status of job %s: %s", job.ID, err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobStatus(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	bot.SetStatusInterval(10 * time.Millisecond)
+	phases := make(chan string)
+	bot.AddCommand("build", NewRequestFuncCommand(func(ctx context.Context, req Request) (string, error) {
+		for phase := range phases {
+			bot.Status(req, phase)
+		}
+		return "built", nil
+	}, "Build", bot.Config()))
+	go bot.Listen()
+
+	backend.Inject("builds", "alice", "!testbot build")
+	phases <- "checking out"
+	msg, err := backend.WaitForMessage("checking out", 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(msg.Text, "Job 1 (`build`) for alice: checking out ("), msg.Text)
+
+	// Each phase edits the same message
+	phases <- "compiling"
+	_, err = backend.WaitForMessage("compiling", 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, backend.Messages(), 1)
+	require.Equal(t, "compiling", bot.Jobs().List()[0].Phase())
+	jobs, err := bot.listJobs(context.Background(), Request{})
+	require.NoError(t, err)
+	require.Contains(t, jobs, "compiling")
+
+	// The elapsed time is kept up to date while the job runs
+	require.Eventually(t, func() bool {
+		return !strings.HasSuffix(backend.Messages()[0].Text, "(0s so far)")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(phases)
+	msg, err = backend.WaitForMessage("finished after", 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(msg.Text, "Job 1 (`build`) for alice finished after "), msg.Text)
+	_, err = backend.WaitForMessage("built", 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, backend.Messages(), 2)
+}
+
+func TestFinishStatus(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+
+	// Jobs that don't go through the bot finish their own status
+	job := bot.Jobs().Start(Request{Channel: "builds", Username: "alice", Args: []string{"build", "--automated"}})
+	bot.Status(job.Request, "building")
+	_, err := backend.WaitForMessage("building", 5*time.Second)
+	require.NoError(t, err)
+	bot.FinishStatus(job.Request, AuditError)
+	bot.Jobs().Finish(job)
+	msg, err := backend.WaitForMessage("failed after", 5*time.Second)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(msg.Text, "Job 1 (`build --automated`) for alice failed after "), msg.Text)
+	require.Len(t, backend.Messages(), 1)
+}
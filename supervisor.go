@@ -0,0 +1,131 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// restarter is a backend that has to reconnect before it can listen again
+// after its Listen returns
+type restarter interface {
+	Restart() error
+}
+
+var errStoppedListening = errors.New("stopped listening")
+
+// MemberHealth is how a HybridBackend member is doing
+type MemberHealth struct {
+	Backend string
+	Channel string
+	Healthy bool
+	// Err is why the member is unhealthy
+	Err error
+	// Since is when the member last changed state
+	Since time.Time
+}
+
+// Health returns how each member is doing
+func (b *HybridBackend) Health() []MemberHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]MemberHealth(nil), b.health...)
+}
+
+// Stop makes Listen return once the members' Listen calls do, instead of
+// restarting them
+func (b *HybridBackend) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+func (b *HybridBackend) stopped() bool {
+	select {
+	case <-b.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *HybridBackend) memberName(member int) string {
+	if named, ok := b.backends[member].Backend.(namedBackend); ok {
+		return named.BackendName()
+	}
+	return fmt.Sprintf("%T", b.backends[member].Backend)
+}
+
+// supervise runs a member's Listen, restarting it with exponential backoff
+// whenever it returns
+func (b *HybridBackend) supervise(member int, runner BotCommandRunner) {
+	backend := b.backends[member].Backend
+	backoff := b.minBackoff
+	for {
+		started := time.Now()
+		healthy := time.AfterFunc(b.healthyAfter, func() { b.setHealth(member, nil) })
+		backend.Listen(runner)
+		healthy.Stop()
+		if b.stopped() {
+			return
+		}
+		// A member that was up long enough to be reported healthy gets a
+		// fresh backoff
+		if time.Since(started) >= b.healthyAfter {
+			backoff = b.minBackoff
+		}
+
+		err := errStoppedListening
+		for {
+			log.Printf("%s %s, restarting in %s", b.memberName(member), err, backoff)
+			b.setHealth(member, err)
+			select {
+			case <-time.After(backoff):
+			case <-b.stop:
+				return
+			}
+			backoff = min(2*backoff, b.maxBackoff)
+			r, ok := backend.(restarter)
+			if !ok {
+				break
+			}
+			if err = r.Restart(); err == nil {
+				break
+			}
+			err = fmt.Errorf("couldn't restart: %w", err)
+		}
+	}
+}
+
+// setHealth records whether a member is healthy, telling the other healthy
+// members when it changes
+func (b *HybridBackend) setHealth(member int, err error) {
+	b.mu.Lock()
+	health := &b.health[member]
+	name := health.Backend
+	changed := health.Healthy != (err == nil)
+	health.Healthy, health.Err = err == nil, err
+	if changed {
+		health.Since = time.Now()
+	}
+	var others []int
+	for i, h := range b.health {
+		if i != member && h.Healthy && b.backends[i].Channel != "" {
+			others = append(others, i)
+		}
+	}
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	msg := fmt.Sprintf("Lost %s (%s), I'm trying to reconnect.", name, err)
+	if err == nil {
+		msg = fmt.Sprintf("%s is back.", name)
+	}
+	for _, i := range others {
+		b.backends[i].Backend.SendMessage(msg, b.backends[i].Channel)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// BackendTest is the backend name of requests from a TestBackend
+const BackendTest = "test"
+
+// TestMessage is a message a TestBackend was asked to send
+type TestMessage struct {
+	Channel string
+	// Thread is the message ID of the thread the message was sent in, if any
+	Thread string
+	// File is the name the message was uploaded as, if it was a file
+	File string
+	Text string
+}
+
+// TestBackend is an in-memory backend for driving a bot end to end in tests.
+// Tests inject messages as if users had sent them and check what the bot sent
+// back.
+type TestBackend struct {
+	// Name is the backend name put in requests, BackendTest by default
+	Name string
+	// Limit is the longest message the backend takes, or 0 for no limit
+	Limit int
+	// Uploads sets whether the backend can upload files
+	Uploads bool
+	// Format is the markup messages are rendered in
+	Format Format
+
+	botName string
+	events  chan *testMessage
+
+	mu             sync.Mutex
+	changed        chan struct{}
+	messages       []TestMessage
+	advertisements []chat1.UserBotCommandInput
+	lastMessageID  int
+	reactions      map[string][]string
+}
+
+// testMessage is an injected message
+type testMessage struct {
+	ChatMessage
+	id string
+}
+
+// NewTestBackend returns a backend that handles messages addressed to
+// "!botName"
+func NewTestBackend(botName string) *TestBackend {
+	return &TestBackend{
+		Name:    BackendTest,
+		botName: botName,
+		events:  make(chan *testMessage, 100),
+		changed: make(chan struct{}),
+	}
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *TestBackend) BackendName() string {
+	return b.Name
+}
+
+// SendMessage records a message
+func (b *TestBackend) SendMessage(text string, channel string) MessageHandle {
+	return b.record(TestMessage{Channel: channel, Text: text})
+}
+
+// record records a sent message, returning its handle
+func (b *TestBackend) record(msg TestMessage) MessageHandle {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, msg)
+	b.notifyLocked()
+	return MessageHandle{Backend: b.Name, Channel: msg.Channel, ID: strconv.Itoa(len(b.messages) - 1)}
+}
+
+// EditMessage replaces the text of a recorded message
+func (b *TestBackend) EditMessage(handle MessageHandle, text string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, err := strconv.Atoi(handle.ID)
+	if err != nil || i < 0 || i >= len(b.messages) {
+		return fmt.Errorf("No message %q", handle.ID)
+	}
+	b.messages[i].Text = text
+	b.notifyLocked()
+	return nil
+}
+
+// AdvertiseCommands records the advertised commands
+func (b *TestBackend) AdvertiseCommands(commands []chat1.UserBotCommandInput) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advertisements = commands
+	b.notifyLocked()
+	return nil
+}
+
+// Listen handles injected messages until Disconnect is called
+func (b *TestBackend) Listen(runner BotCommandRunner) {
+	for msg := range b.events {
+		if msg == nil {
+			return
+		}
+		observeMessage(runner, msg.ChatMessage)
+		args := parseInput(msg.Text)
+		if len(args) == 0 || args[0] != "!"+b.botName {
+			continue
+		}
+		req := Request{
+			Args:      args[1:],
+			Backend:   msg.Backend,
+			Channel:   msg.Channel,
+			UserID:    msg.UserID,
+			Username:  msg.Username,
+			MessageID: msg.id,
+			Text:      msg.Text,
+		}
+		if err := runner.RunCommand(req); err != nil {
+			b.SendMessage(fmt.Sprintf("failed to run command: %s", err), req.Channel)
+		}
+	}
+}
+
+// Inject delivers a message from user in channel, as if it had been typed,
+// returning its message ID. Like the real backends, only messages starting
+// with "!botName" run.
+func (b *TestBackend) Inject(channel, user, text string) string {
+	b.mu.Lock()
+	b.lastMessageID++
+	id := strconv.Itoa(b.lastMessageID)
+	b.mu.Unlock()
+	b.events <- &testMessage{
+		ChatMessage: ChatMessage{
+			Backend:  b.Name,
+			Channel:  channel,
+			UserID:   user,
+			Username: user,
+			Text:     text,
+		},
+		id: id,
+	}
+	return id
+}
+
+// ReplyInThread records a message in the thread on the request's message
+func (b *TestBackend) ReplyInThread(req Request, text string) (MessageHandle, error) {
+	return b.record(TestMessage{Channel: req.Channel, Thread: threadOf(req), Text: text}), nil
+}
+
+// messageLimit is the backend's Limit
+func (b *TestBackend) messageLimit(Request) int {
+	return b.Limit
+}
+
+// messageFormat is the backend's Format
+func (b *TestBackend) messageFormat(Request) Format {
+	return b.Format
+}
+
+// UploadFile records a file if the backend has Uploads
+func (b *TestBackend) UploadFile(req Request, name, _, content string) error {
+	if !b.Uploads {
+		return ErrUploadsUnsupported
+	}
+	b.record(TestMessage{Channel: req.Channel, Thread: req.ThreadID, File: name, Text: content})
+	return nil
+}
+
+// React records a reaction on a message
+func (b *TestBackend) React(req Request, reaction string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reactions == nil {
+		b.reactions = make(map[string][]string)
+	}
+	b.reactions[req.MessageID] = append(b.reactions[req.MessageID], reaction)
+	b.notifyLocked()
+	return nil
+}
+
+// Unreact removes a reaction from a message
+func (b *TestBackend) Unreact(req Request, reaction string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reactions[req.MessageID] = slices.DeleteFunc(b.reactions[req.MessageID], func(r string) bool { return r == reaction })
+	b.notifyLocked()
+	return nil
+}
+
+// Reactions returns the reactions on a message
+func (b *TestBackend) Reactions(messageID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.reactions[messageID]...)
+}
+
+// Disconnect makes Listen return, as if the connection had dropped
+func (b *TestBackend) Disconnect() {
+	b.events <- nil
+}
+
+// Messages returns the messages sent so far
+func (b *TestBackend) Messages() []TestMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]TestMessage(nil), b.messages...)
+}
+
+// Advertisements returns the last commands advertised
+func (b *TestBackend) Advertisements() []chat1.UserBotCommandInput {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.advertisements
+}
+
+// WaitForMessage waits for a message containing substr to be sent
+func (b *TestBackend) WaitForMessage(substr string, timeout time.Duration) (TestMessage, error) {
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		changed := b.changed
+		for _, msg := range b.messages {
+			if strings.Contains(msg.Text, substr) {
+				b.mu.Unlock()
+				return msg, nil
+			}
+		}
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return TestMessage{}, fmt.Errorf("No message containing %q after %s, got: %q", substr, timeout, b.Messages())
+		}
+	}
+}
+
+// notifyLocked wakes anything waiting for a message
+func (b *TestBackend) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import "fmt"
+
+// threadReplier is a backend that can reply in a thread on the message a
+// request came from
+type threadReplier interface {
+	ReplyInThread(req Request, text string) (MessageHandle, error)
+}
+
+// threadOf returns the thread replies to req go in: the thread the command
+// was sent in, or else one started on the command's message
+func threadOf(req Request) string {
+	if req.ThreadID != "" {
+		return req.ThreadID
+	}
+	return req.MessageID
+}
+
+// SetThreadReplies makes replies about jobs, like their output and progress,
+// go in a thread on the command's message, on backends that support threads.
+// When a job finishes, a one-line summary is posted in the channel.
+func (b *Bot) SetThreadReplies(enabled bool) {
+	b.threadReplies = enabled
+}
+
+// threaded checks whether replies to req go in a thread
+func (b *Bot) threaded(req Request) bool {
+	if !b.threadReplies || req.JobID == "" || req.MessageID == "" {
+		return false
+	}
+	_, ok := b.backend.(threadReplier)
+	return ok
+}
+
+// jobSummary describes how a job ended, for the channel it was run from
+func jobSummary(req Request, status string) string {
+	return fmt.Sprintf("Job %s (`%s`) for %s %s. Details are in the thread.",
+		req.JobID, commandLine(req.Args), req.Sender(), jobOutcome(status))
+}
+
+// jobOutcome describes an audit status, as in "job 3 failed"
+func jobOutcome(status string) string {
+	switch status {
+	case AuditOK:
+		return "finished"
+	case AuditError:
+		return "failed"
+	case AuditCancelled:
+		return "was cancelled"
+	case AuditTimedOut:
+		return "timed out"
+	case AuditBusy:
+		return "didn't run, its lock was busy"
+	}
+	return "ended: " + status
+}
@@ -4,17 +4,17 @@
 package main
 
 import (
+	"context"
 	"log"
+	"time"
 
 	"github.com/keybase/slackbot"
 )
 
-func main() {
-	backend, err := slackbot.NewSlackBotBackend(slackbot.GetTokenFromEnv())
-	if err != nil {
-		log.Fatal(err)
-	}
-	bot := slackbot.NewBot(slackbot.ReadConfigOrDefault(), "tuxbot", "", backend)
+// setupBot adds the basic commands and the tuxbot extension to bot
+func setupBot(bot *slackbot.Bot) {
+	bot.SetDefaultTimeout(time.Hour)
+	bot.SetOptions("build", slackbot.CommandOptions{Timeout: 4 * time.Hour})
 
 	bot.AddCommand("date", slackbot.NewExecCommand("/bin/date", nil, true, "Show the current date", bot.Config()))
 	bot.AddCommand("pause", slackbot.NewPauseCommand(bot.Config()))
@@ -24,11 +24,37 @@ func main() {
 
 	// Extension
 	ext := &tuxbot{bot: bot}
-	runFn := func(channel string, args []string) (string, error) {
-		return ext.Run(bot, channel, args)
+	runFn := func(ctx context.Context, req slackbot.Request) (string, error) {
+		return ext.Run(ctx, bot, req)
+	}
+	bot.SetDefault(slackbot.NewRequestFuncCommand(runFn, "Extension", bot.Config()))
+	bot.SetHelpDocument(append(bot.HelpDocument(), slackbot.CodeBlock(ext.Help(bot))))
+}
+
+func main() {
+	// A REPL stands in for Slack when developing
+	var backend slackbot.BotBackend
+	if repl, ok := slackbot.NewREPLBackendFromEnv("tuxbot"); ok {
+		backend = repl
+	} else {
+		var err error
+		if backend, err = slackbot.NewSlackBackendFromEnv(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bot := slackbot.NewBot(slackbot.ReadConfigOrDefault(), "tuxbot", "", backend)
+	setupBot(bot)
+
+	if path, err := slackbot.AuditLogPath(); err != nil {
+		log.Printf("Not keeping an audit log: %s", err)
+	} else if err := bot.SetAuditLog(path); err != nil {
+		log.Printf("Error opening audit log: %s", err)
+	}
+	if path, err := slackbot.JobsPath(); err != nil {
+		log.Printf("Not saving jobs: %s", err)
+	} else if err := bot.RestoreJobs(path); err != nil {
+		log.Printf("Error restoring jobs: %s", err)
 	}
-	bot.SetDefault(slackbot.NewFuncCommand(runFn, "Extension", bot.Config()))
-	bot.SetHelp(bot.HelpMessage() + "\n\n" + ext.Help(bot))
 
 	log.Println("Started tuxbot")
 	bot.Listen()
@@ -4,8 +4,10 @@
 package main
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/keybase/slackbot"
 )
@@ -16,7 +18,7 @@ func TestBuildLinux(t *testing.T) {
 		t.Fatal(err)
 	}
 	ext := &tuxbot{}
-	out, err := ext.Run(bot, "", []string{"build", "linux"})
+	out, err := ext.Run(context.Background(), bot, slackbot.Request{Args: []string{"build", "linux"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -31,7 +33,7 @@ func TestInvalidUsage(t *testing.T) {
 		t.Fatal(err)
 	}
 	ext := &tuxbot{}
-	out, err := ext.Run(bot, "", []string{"build", "oops"})
+	out, err := ext.Run(context.Background(), bot, slackbot.Request{Args: []string{"build", "oops"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,7 +48,7 @@ func TestBuildLinuxSkipCI(t *testing.T) {
 		t.Fatal(err)
 	}
 	ext := &tuxbot{}
-	out, err := ext.Run(bot, "", []string{"build", "linux", "--skip-ci"})
+	out, err := ext.Run(context.Background(), bot, slackbot.Request{Args: []string{"build", "linux", "--skip-ci"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,3 +56,16 @@ func TestBuildLinuxSkipCI(t *testing.T) {
 		t.Errorf("Unexpected output: %s", out)
 	}
 }
+
+func TestConversation(t *testing.T) {
+	backend := slackbot.NewTestBackend("tuxbot")
+	bot := slackbot.NewBot(slackbot.NewConfig(true, false), "tuxbot", "", backend)
+	setupBot(bot)
+	go bot.Listen()
+	defer backend.Disconnect()
+
+	backend.Inject("builds", "alice", "!tuxbot build linux --skip-ci")
+	if _, err := backend.WaitForMessage("Dry Run: Doing that would run `prerelease.sh` with NOWAIT=1 set", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
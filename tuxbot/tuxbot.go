@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,49 +14,45 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/keybase/slackbot"
 	"github.com/keybase/slackbot/cli"
-	"github.com/nlopes/slack"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
-func (t *tuxbot) linuxBuildFunc(channel string, _ []string, skipCI bool, nightly bool) (string, error) {
+func (t *tuxbot) linuxBuildFunc(ctx context.Context, req slackbot.Request, skipCI bool, nightly bool) (string, error) {
 	currentUser, err := user.Current()
 	if err != nil {
 		return "", err
 	}
-	t.bot.SendMessage("building linux!!!", channel)
+	phase := "building linux"
 	prereleaseScriptPath := filepath.Join(currentUser.HomeDir, "slackbot/systemd/prerelease.sh")
-	//nolint:gosec,noctx // Executing build script from known location in user's home directory, no context available
-	prereleaseCmd := exec.Command(prereleaseScriptPath)
+	//nolint:gosec // Executing build script from known location in user's home directory
+	prereleaseCmd := exec.CommandContext(ctx, prereleaseScriptPath)
 	prereleaseCmd.Stdout = os.Stdout
 	prereleaseCmd.Stderr = os.Stderr
 	prereleaseCmd.Env = os.Environ()
 	if skipCI {
 		prereleaseCmd.Env = append(prereleaseCmd.Env, "NOWAIT=1")
-		t.bot.SendMessage("--- with NOWAIT=1", channel)
+		phase += " with NOWAIT=1"
 	}
 	if nightly {
 		prereleaseCmd.Env = append(prereleaseCmd.Env, "KEYBASE_NIGHTLY=1")
-		t.bot.SendMessage("--- with KEYBASE_NIGHTLY=1", channel)
+		phase += " with KEYBASE_NIGHTLY=1"
 	}
+	t.bot.Status(req, phase)
 	err = prereleaseCmd.Run()
 	if err != nil {
-		//nolint:noctx // Error logging command, no request context available
-		journal, journalErr := exec.Command("journalctl", "--since=today", "--user-unit", "keybase.keybot.service").CombinedOutput()
+		// Still collect the journal when the build was cancelled
+		journalCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		journal, journalErr := exec.CommandContext(journalCtx, "journalctl", "--since=today", "--user-unit", "keybase.keybot.service").CombinedOutput()
 		if journalErr != nil {
 			log.Printf("Error getting journal: %s", journalErr)
 		}
-		api := slack.New(slackbot.GetTokenFromEnv())
-		snippetFile := slack.FileUploadParameters{
-			Channels: []string{channel},
-			Title:    "failed build output",
-			Content:  string(journal),
-		}
-		if _, uploadErr := api.UploadFile(snippetFile); uploadErr != nil {
-			log.Printf("Error uploading build output: %s", uploadErr)
-		}
+		t.bot.SendFile(req, "journal.txt", "failed build output", string(journal))
 		return "FAILURE", err
 	}
 	return "SUCCESS", nil
@@ -65,7 +62,7 @@ type tuxbot struct {
 	bot *slackbot.Bot
 }
 
-func (t *tuxbot) Run(bot *slackbot.Bot, channel string, args []string) (string, error) {
+func (t *tuxbot) Run(ctx context.Context, bot *slackbot.Bot, req slackbot.Request) (string, error) {
 	app := kingpin.New("tuxbot", "Command parser for tuxbot")
 	app.Terminate(nil)
 	stringBuffer := new(bytes.Buffer)
@@ -76,7 +73,7 @@ func (t *tuxbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 	buildLinuxSkipCI := buildLinux.Flag("skip-ci", "Whether to skip CI").Bool()
 	buildLinuxNightly := buildLinux.Flag("nightly", "Trigger a nightly build instead of main channel").Bool()
 
-	cmd, usage, err := cli.Parse(app, args, stringBuffer)
+	cmd, usage, err := cli.Parse(app, req.Args, stringBuffer)
 	if usage != "" || err != nil {
 		return usage, err
 	}
@@ -92,13 +89,16 @@ func (t *tuxbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 			return "I'm paused so I can't do that, but I would have run `prerelease.sh`", nil
 		}
 
-		ret, err := t.linuxBuildFunc(channel, args, *buildLinuxSkipCI, *buildLinuxNightly)
+		ret, err := t.linuxBuildFunc(ctx, req, *buildLinuxSkipCI, *buildLinuxNightly)
 
+		// Report cancelled builds as failures too
+		statCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
 		var stathatErr error
 		if err == nil {
-			stathatErr = postStathat("tuxbot - nightly - success", "1")
+			stathatErr = postStathat(statCtx, "tuxbot - nightly - success", "1")
 		} else {
-			stathatErr = postStathat("tuxbot - nightly - failure", "1")
+			stathatErr = postStathat(statCtx, "tuxbot - nightly - failure", "1")
 		}
 		if stathatErr != nil {
 			return fmt.Sprintf("stathat error. original message: %s", ret),
@@ -111,7 +111,7 @@ func (t *tuxbot) Run(bot *slackbot.Bot, channel string, args []string) (string,
 	return cmd, nil
 }
 
-func postStathat(key string, count string) error {
+func postStathat(ctx context.Context, key string, count string) error {
 	ezkey := os.Getenv("STATHAT_EZKEY")
 	if ezkey == "" {
 		return fmt.Errorf("no stathat key")
@@ -121,8 +121,12 @@ func postStathat(key string, count string) error {
 		"stat":  {key},
 		"count": {count},
 	}
-	//nolint:noctx // Simple fire-and-forget stat reporting, no request context available
-	resp, err := http.PostForm("https://api.stathat.com/ez", vals)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.stathat.com/ez", strings.NewReader(vals.Encode()))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(httpReq)
 	if resp != nil {
 		defer func() {
 			if closeErr := resp.Body.Close(); closeErr != nil {
@@ -134,7 +138,7 @@ func postStathat(key string, count string) error {
 }
 
 func (t *tuxbot) Help(bot *slackbot.Bot) string {
-	out, err := t.Run(bot, "", nil)
+	out, err := t.Run(context.Background(), bot, slackbot.Request{})
 	if err != nil {
 		return fmt.Sprintf("Error getting help: %s", err)
 	}
@@ -0,0 +1,96 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// DefaultUploadThreshold is how long a reply can be before it's uploaded as a
+// file instead, on backends that can upload
+const DefaultUploadThreshold = 12000
+
+// FileUploader is a backend that can upload files, like build logs
+type FileUploader interface {
+	// UploadFile uploads content as a file named name, with an optional title,
+	// to req's channel, in req's thread if it has one. It returns
+	// ErrUploadsUnsupported if it can't upload there.
+	UploadFile(req Request, name, title, content string) error
+}
+
+// ErrUploadsUnsupported means a backend can't upload where a request came
+// from, so the file is sent as messages instead
+var ErrUploadsUnsupported = errors.New("Uploads aren't supported")
+
+// SetUploadThreshold sets how long a reply can be before it's uploaded as a
+// file, on backends that can upload. 0 turns uploads off, so long replies are
+// always split into several messages.
+func (b *Bot) SetUploadThreshold(threshold int) {
+	b.uploadThreshold = threshold
+}
+
+// SendFile uploads content as a file to where req came from, or sends it in a
+// code block, split into as many messages as it takes, if the backend can't
+// upload there
+func (b *Bot) SendFile(req Request, name, title, content string) {
+	if b.upload(req, name, title, content) {
+		return
+	}
+	text := BlockQuote(content)
+	if title != "" {
+		text = title + ":\n" + text
+	}
+	b.replyMessages(req, text)
+}
+
+// upload uploads a file to where req came from, returning whether it did
+func (b *Bot) upload(req Request, name, title, content string) bool {
+	u, ok := b.backend.(FileUploader)
+	if !ok {
+		return false
+	}
+	if b.threaded(req) {
+		req.ThreadID = threadOf(req)
+	}
+	if err := u.UploadFile(req, name, title, content); err != nil {
+		if !errors.Is(err, ErrUploadsUnsupported) {
+			log.Printf("Error uploading %s, sending it as messages: %s", name, err)
+		}
+		return false
+	}
+	return true
+}
+
+// uploadReply uploads text as a file if it's longer than the upload
+// threshold, returning whether it did
+func (b *Bot) uploadReply(req Request, text string) bool {
+	if b.uploadThreshold <= 0 || len(text) <= b.uploadThreshold {
+		return false
+	}
+	return b.upload(req, uploadName(req), "", unquote(text))
+}
+
+// uploadName names the file a reply to req is uploaded as
+func uploadName(req Request) string {
+	name := "output"
+	if len(req.Args) > 0 {
+		name = req.Args[0]
+	}
+	if req.JobID != "" {
+		name += "-" + req.JobID
+	}
+	return name + ".txt"
+}
+
+// unquote strips the code block BlockQuote puts around s, if s is just one
+// code block
+func unquote(s string) string {
+	inner, ok := strings.CutPrefix(s, codeFence+"\n")
+	if !ok || !strings.HasSuffix(inner, codeFence) || strings.Count(inner, codeFence) != 1 {
+		return s
+	}
+	return strings.TrimSuffix(inner, codeFence)
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendFile(t *testing.T) {
+	backend := NewTestBackend("testbot")
+	backend.Limit = 100
+	bot := NewBot(NewConfig(true, false), "testbot", "", backend)
+	req := Request{Backend: BackendTest, Channel: "builds"}
+	journal := strings.Repeat("journal line\n", 10)
+
+	// Without uploads, the file is sent as messages
+	bot.SendFile(req, "journal.txt", "failed build output", journal)
+	messages := backend.Messages()
+	require.Len(t, messages, 2)
+	require.Equal(t, "failed build output:\n"+codeFence+"\n"+strings.Repeat("journal line\n", 5)+codeFence, messages[0].Text)
+	require.Equal(t, codeFence+"\n"+strings.Repeat("journal line\n", 5)+codeFence, messages[1].Text)
+
+	backend.Uploads = true
+	bot.SendFile(req, "journal.txt", "failed build output", journal)
+	require.Equal(t, TestMessage{Channel: "builds", File: "journal.txt", Text: journal}, backend.Messages()[2])
+}
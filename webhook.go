@@ -0,0 +1,202 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackendWebhook is the backend name of requests from a WebhookBackend
+const BackendWebhook = "webhook"
+
+const (
+	defaultWebhookWait = 30 * time.Second
+	maxWebhookWait     = 10 * time.Minute
+	maxWebhookBodySize = 64 * 1024
+)
+
+// WebhookBackend is a bot backend for CI and other programs. They POST a JSON
+// command to /commands with a bearer token, and get its output and job ID back
+// as JSON. Commands go through the same pause, dry run and auth checks as chat
+// messages, as the user the token belongs to.
+type WebhookBackend struct {
+	addr   string
+	tokens map[string]string
+
+	echo        BotBackend
+	echoChannel string
+
+	mu     sync.Mutex
+	runner BotCommandRunner
+}
+
+// webhookCommand is the body of a POST to /commands
+type webhookCommand struct {
+	Args []string `json:"args"`
+	// Wait is how long to wait for the command to finish (like "5m") before
+	// answering with just its job ID. Defaults to 30s.
+	Wait string `json:"wait"`
+}
+
+// WebhookResult is the response to a POST to /commands
+type WebhookResult struct {
+	JobID  string `json:"job_id,omitempty"`
+	Status string `json:"status"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewWebhookBackend serves commands on addr. tokens maps each bearer token to
+// the user it authenticates as.
+func NewWebhookBackend(addr string, tokens map[string]string) *WebhookBackend {
+	return &WebhookBackend{addr: addr, tokens: tokens}
+}
+
+// SetEcho also sends the bot's messages to a chat channel on another
+// backend, so people can follow commands CI runs
+func (b *WebhookBackend) SetEcho(backend BotBackend, channel string) {
+	b.echo = backend
+	b.echoChannel = channel
+}
+
+// BackendName is the Request.Backend of requests from this backend
+func (b *WebhookBackend) BackendName() string {
+	return BackendWebhook
+}
+
+// SendMessage echoes a message to chat, if SetEcho was called
+func (b *WebhookBackend) SendMessage(text string, _ string) MessageHandle {
+	if b.echo == nil {
+		log.Printf("Webhook message: %s", text)
+		return MessageHandle{}
+	}
+	return b.echo.SendMessage(text, b.echoChannel)
+}
+
+// Handler returns the HTTP handler for commands, sending them to runner
+func (b *WebhookBackend) Handler(runner BotCommandRunner) http.Handler {
+	b.mu.Lock()
+	b.runner = runner
+	b.mu.Unlock()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/commands", b.handleCommand)
+	return mux
+}
+
+// Listen serves the HTTP endpoint
+func (b *WebhookBackend) Listen(runner BotCommandRunner) {
+	server := &http.Server{
+		Addr:              b.addr,
+		Handler:           b.Handler(runner),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving webhook commands on %s", b.addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("Webhook server stopped: %s", err)
+	}
+}
+
+// user returns who the request's bearer token belongs to
+func (b *WebhookBackend) user(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	for candidate, user := range b.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func writeWebhookResult(w http.ResponseWriter, code int, result WebhookResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error writing webhook response: %s", err)
+	}
+}
+
+func (b *WebhookBackend) handleCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeWebhookResult(w, http.StatusMethodNotAllowed, WebhookResult{Status: AuditError, Error: "POST a command"})
+		return
+	}
+	user, ok := b.user(r)
+	if !ok {
+		writeWebhookResult(w, http.StatusUnauthorized, WebhookResult{Status: AuditDenied, Error: "Invalid token"})
+		return
+	}
+	var cmd webhookCommand
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookBodySize)).Decode(&cmd); err != nil {
+		writeWebhookResult(w, http.StatusBadRequest, WebhookResult{Status: AuditError, Error: err.Error()})
+		return
+	}
+	if len(cmd.Args) == 0 {
+		writeWebhookResult(w, http.StatusBadRequest, WebhookResult{Status: AuditError, Error: "No args"})
+		return
+	}
+	wait := defaultWebhookWait
+	if cmd.Wait != "" {
+		d, err := time.ParseDuration(cmd.Wait)
+		if err != nil {
+			writeWebhookResult(w, http.StatusBadRequest, WebhookResult{Status: AuditError, Error: err.Error()})
+			return
+		}
+		wait = min(d, maxWebhookWait)
+	}
+
+	started := make(chan string, 1)
+	done := make(chan Result, 1)
+	req := Request{
+		Args:     cmd.Args,
+		Backend:  BackendWebhook,
+		UserID:   user,
+		Username: user,
+		Text:     commandLine(cmd.Args),
+		Started:  func(jobID string) { started <- jobID },
+		Done:     func(result Result) { done <- result },
+	}
+	b.mu.Lock()
+	runner := b.runner
+	b.mu.Unlock()
+	log.Printf("Webhook command %q from %s", cmd.Args, user)
+	if err := runner.RunCommand(req); err != nil {
+		writeWebhookResult(w, http.StatusBadRequest, WebhookResult{Status: AuditUnrecognized, Error: err.Error()})
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var jobID string
+	for {
+		select {
+		case jobID = <-started:
+		case result := <-done:
+			response := WebhookResult{JobID: result.JobID, Status: result.Status, Output: result.Output}
+			if result.Err != nil {
+				response.Error = result.Err.Error()
+			}
+			code := http.StatusOK
+			if result.Status == AuditDenied {
+				code = http.StatusForbidden
+			}
+			writeWebhookResult(w, code, response)
+			return
+		case <-timer.C:
+			writeWebhookResult(w, http.StatusAccepted, WebhookResult{JobID: jobID, Status: "running"})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
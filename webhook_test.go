@@ -0,0 +1,83 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package slackbot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookBackend(t *testing.T) {
+	chat := NewTestBackend("testbot")
+	backend := NewWebhookBackend("", map[string]string{"ci-token": "ci"})
+	backend.SetEcho(chat, "builds")
+	cfg := &config{AuthField: AuthPolicy{Commands: map[string]AuthRule{"release": {Users: []string{"alice"}}}}}
+	bot := NewBot(cfg, "testbot", "", backend)
+	release := make(chan struct{})
+	bot.AddCommand("echo", NewRequestFuncCommand(func(_ context.Context, req Request) (string, error) {
+		return strings.Join(req.Args[1:], " ") + " from " + req.Sender(), nil
+	}, "Echo", bot.Config()))
+	bot.AddCommand("build", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		<-release
+		return "built", nil
+	}, "Build", bot.Config()))
+	bot.AddCommand("release", NewRequestFuncCommand(func(context.Context, Request) (string, error) {
+		return "released", nil
+	}, "Release", bot.Config()))
+	handler := backend.Handler(bot)
+
+	post := func(token, body string) (int, WebhookResult) {
+		req := httptest.NewRequest(http.MethodPost, "/commands", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var result WebhookResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+		return w.Code, result
+	}
+
+	code, _ := post("", `{"args": ["echo", "hi"]}`)
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = post("wrong", `{"args": ["echo", "hi"]}`)
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = post("ci-token", `{"args": []}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, result := post("ci-token", `{"args": ["echo", "hi"]}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, AuditOK, result.Status)
+	require.Equal(t, "hi from ci", result.Output)
+	require.NotEmpty(t, result.JobID)
+	_, err := chat.WaitForMessage("hi from ci", 5*time.Second)
+	require.NoError(t, err)
+
+	code, result = post("ci-token", `{"args": ["release", "promote"]}`)
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, AuditDenied, result.Status)
+
+	// Long commands answer with their job ID and keep running
+	code, result = post("ci-token", `{"args": ["build", "darwin"], "wait": "10ms"}`)
+	require.Equal(t, http.StatusAccepted, code)
+	require.Equal(t, "running", result.Status)
+	job, ok := bot.Jobs().Get(result.JobID)
+	require.True(t, ok)
+	require.Equal(t, []string{"build", "darwin"}, job.Request.Args)
+	close(release)
+	_, err = chat.WaitForMessage("built", 5*time.Second)
+	require.NoError(t, err)
+
+	bot.Config().SetPaused(true)
+	code, result = post("ci-token", `{"args": ["echo", "hi"]}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, AuditPaused, result.Status)
+}